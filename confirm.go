@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"net/mail"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/Masterminds/sprig/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultConfirmationSubject = "Thanks, we received your message"
+	defaultConfirmationText    = "Thanks for getting in touch, we received your message and will get back to you soon."
+	// defaultConfirmationThrottle is how long to wait before sending another
+	// confirmation to the same address
+	defaultConfirmationThrottle = time.Hour
+)
+
+// TargetConfirmation is an auto-reply sent back to the submitter's email
+type TargetConfirmation struct {
+	From    string `yaml:"from"`
+	Subject string `yaml:"subject"`
+	Text    string `yaml:"text"`
+	HTML    string `yaml:"html"`
+	// IncludeSubmission adds a copy of the submitted message
+	IncludeSubmission bool `yaml:"include-submission"`
+	// Throttle is the least amount of time between two confirmations to the
+	// same address, so dispatch cannot be used to flood someone's inbox
+	Throttle time.Duration `yaml:"throttle"`
+	// Output is the smtp or sendmail output to send through, the first one
+	// of the target when empty
+	Output string `yaml:"output"`
+
+	transport       Transport
+	subjectTemplate *template.Template
+	textTemplate    *template.Template
+	htmlTemplate    *htmltemplate.Template
+}
+
+// prepare sets the defaults of the confirmation and parses its templates
+func (c *TargetConfirmation) prepare(target DispatchTarget) error {
+	var err error
+	if len(c.From) == 0 {
+		c.From = target.From
+	}
+	if len(c.From) > 0 {
+		if c.From, err = FormatEmail(c.From); err != nil {
+			return fmt.Errorf("from: %v", err)
+		}
+	}
+	if c.Throttle < 0 {
+		return errors.New("throttle can not be negative")
+	}
+	if c.Throttle == 0 {
+		c.Throttle = defaultConfirmationThrottle
+	}
+	if len(c.Subject) == 0 {
+		c.Subject = defaultConfirmationSubject
+	}
+	if len(c.Text) == 0 && len(c.HTML) == 0 {
+		c.Text = defaultConfirmationText
+	}
+
+	if c.subjectTemplate, err = template.New("subject").Funcs(sprig.TxtFuncMap()).Parse(c.Subject); err != nil {
+		return err
+	}
+	if len(c.Text) > 0 {
+		if c.textTemplate, err = template.New("text").Funcs(sprig.TxtFuncMap()).Parse(c.Text); err != nil {
+			return err
+		}
+	}
+	if len(c.HTML) > 0 {
+		if c.htmlTemplate, err = htmltemplate.New("html").Funcs(htmlFuncMap()).Parse(c.HTML); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolveOutput finds the transport of the confirmation output, targets
+// without an email output send confirmations through the SMTP relays
+func (c *TargetConfirmation) resolveOutput(target DispatchTarget, transports []Transport) error {
+	emails := target.emailOutputs()
+	name := c.Output
+	if len(name) > 0 && !contains(emails, name) {
+		return fmt.Errorf("confirmation output '%s' is not an smtp or sendmail output", name)
+	}
+	if len(name) == 0 && len(emails) > 0 {
+		name = emails[0]
+	}
+	c.transport = nil
+	for _, transport := range transports {
+		if transport.Name() == name {
+			c.transport = transport
+			break
+		}
+	}
+	return nil
+}
+
+// build renders the confirmation for a message that was delivered
+func (c *TargetConfirmation) build(to string, domain string, delivered Message) (Message, error) {
+	var msg Message
+	msg.FromAddress = c.From
+	msg.ToAddressList = []string{to}
+	msg.MessageID = newMessageID(domain)
+
+	var subject bytes.Buffer
+	if err := c.subjectTemplate.Execute(&subject, delivered.Fields); err != nil {
+		return msg, fmt.Errorf("subject template: %v", err)
+	}
+	msg.Subject = sanitizeSubject(subject.String())
+
+	if c.textTemplate != nil {
+		var text bytes.Buffer
+		if err := c.textTemplate.Execute(&text, delivered.Fields); err != nil {
+			return msg, fmt.Errorf("text template: %v", err)
+		}
+		msg.TextMessage = text.String()
+		if c.IncludeSubmission {
+			msg.TextMessage += "\n\n----- Your message -----\n" + delivered.TextMessage
+		}
+	}
+	if c.htmlTemplate != nil {
+		var html bytes.Buffer
+		if err := c.htmlTemplate.Execute(&html, delivered.Fields); err != nil {
+			return msg, fmt.Errorf("html template: %v", err)
+		}
+		if c.IncludeSubmission {
+			html.WriteString("<hr><pre>")
+			htmltemplate.HTMLEscape(&html, []byte(delivered.TextMessage))
+			html.WriteString("</pre>")
+		}
+		msg.HTMLMessage = html.String()
+	}
+	return msg, nil
+}
+
+// confirmationThrottle remembers who was recently sent a confirmation
+type confirmationThrottle struct {
+	mutex     sync.Mutex
+	next      map[string]time.Time
+	lastPrune time.Time
+}
+
+func newConfirmationThrottle() *confirmationThrottle {
+	return &confirmationThrottle{next: map[string]time.Time{}}
+}
+
+// allow returns true if a confirmation can be sent to the address now, and
+// holds off any others for the interval, whichever target sends them
+func (t *confirmationThrottle) allow(address string, interval time.Duration) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	now := time.Now()
+	if now.Sub(t.lastPrune) > time.Minute {
+		for key, next := range t.next {
+			if !now.Before(next) {
+				delete(t.next, key)
+			}
+		}
+		t.lastPrune = now
+	}
+
+	key := strings.ToLower(address)
+	if next, found := t.next[key]; found && now.Before(next) {
+		return false
+	}
+	t.next[key] = now.Add(interval)
+	return true
+}
+
+// release lets the address be sent a confirmation again, for when sending
+// the one that was allowed failed
+func (t *confirmationThrottle) release(address string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.next, strings.ToLower(address))
+}
+
+// confirm sends the confirmation of the target to the submitter
+func (d *Dispatch) confirm(target DispatchTarget, delivered Message) {
+	c := target.Confirmation
+	address, err := mail.ParseAddress(delivered.Fields["email"])
+	if err != nil {
+		log.Debugf("target %s: no email to send a confirmation too", target.Name)
+		return
+	}
+	if !d.confirmations.allow(address.Address, c.Throttle) {
+		log.Infof("target %s: not confirming to %s again so soon", target.Name, address.Address)
+		return
+	}
+
+	to := getReplyTo(address.Address, delivered.Fields["name"])
+	msg, err := c.build(to, d.messageIDDomain, delivered)
+	if err != nil {
+		log.Errorf("error: target %s confirmation %v", target.Name, err)
+		return
+	}
+	if c.transport != nil {
+		err = c.transport.Send(context.Background(), msg)
+	} else {
+		err = sendMessage(context.Background(), msg, d.relays, nil)
+	}
+	if err != nil {
+		d.confirmations.release(address.Address)
+		log.Errorf("error: target %s confirmation failed: %v", target.Name, err)
+		return
+	}
+	log.Infof("sent confirmation: {Target:%s}", target.Name)
+}
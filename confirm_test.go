@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfirmation(t *testing.T) {
+	data := []byte(`
+name: example
+from: dispatch@my-site.com
+to: [admin@my-site.com]
+confirmation:
+  subject: "Thanks {{ .name }}"
+  html: "<p>Hi {{ .name }}</p>"
+  include-submission: true
+`)
+	target, err := loadTarget("example.yml", data)
+	assert.NoError(t, err)
+	assert.Equal(t, "dispatch@my-site.com", target.Confirmation.From)
+	assert.Equal(t, time.Hour, target.Confirmation.Throttle)
+
+	inbox := NewInbox(10)
+	d := NewDispatch(t.TempDir(), SMTPSettings{Inbox: inbox})
+	assert.NoError(t, d.AddTarget(target))
+	target = d.nameMap["example"]
+
+	request := DispatchRequest{"name": "Jo", "email": "jo@anywhere.com", "message": "<hi>"}
+	_, err = d.SendTarget(target, request)
+	assert.NoError(t, err)
+	assert.NoError(t, d.Wait(context.Background()))
+	messages := inbox.Messages()
+	if assert.Len(t, messages, 2) {
+		assert.Equal(t, []string{`"Jo" <jo@anywhere.com>`}, messages[0].To)
+		assert.Equal(t, "Thanks Jo", messages[0].Subject)
+		assert.Contains(t, messages[0].HTML, "<p>Hi Jo</p><hr><pre>")
+		assert.Contains(t, messages[0].HTML, "&lt;hi&gt;")
+	}
+
+	// a second submission from the same address is not confirmed
+	request["email"] = "JO@anywhere.com"
+	_, err = d.SendTarget(target, request)
+	assert.NoError(t, err)
+	assert.NoError(t, d.Wait(context.Background()))
+	assert.Len(t, inbox.Messages(), 3)
+
+	// nor is a submission to another target
+	other, err := loadTarget("other.yml", []byte("name: other\nto: [admin@my-site.com]\nconfirmation: {}\n"))
+	assert.NoError(t, err)
+	assert.NoError(t, d.AddTarget(other))
+	_, err = d.SendTarget(d.nameMap["other"], request)
+	assert.NoError(t, err)
+	assert.NoError(t, d.Wait(context.Background()))
+	assert.Len(t, inbox.Messages(), 4)
+
+	_, err = loadTarget("example.yml", []byte(`confirmation: {throttle: -1s}`))
+	assert.Error(t, err)
+	_, err = loadTarget("example.yml", []byte(`confirmation: {subject: "{{ .name "}`))
+	assert.Error(t, err)
+}
+
+func TestConfirmationThrottle(t *testing.T) {
+	throttle := newConfirmationThrottle()
+	assert.True(t, throttle.allow("jo@anywhere.com", time.Hour))
+	assert.False(t, throttle.allow("jo@anywhere.com", time.Hour))
+	assert.False(t, throttle.allow("JO@anywhere.com", time.Hour))
+	assert.True(t, throttle.allow("sam@anywhere.com", time.Millisecond))
+	time.Sleep(2 * time.Millisecond)
+	assert.True(t, throttle.allow("sam@anywhere.com", time.Millisecond))
+}
+
+func TestConfirmationOutput(t *testing.T) {
+	data := []byte(`
+name: example
+to: [admin@my-site.com]
+outputs:
+  - name: chat
+    type: ntfy
+    topic: contact
+  - name: local-mta
+    type: sendmail
+confirmation: {}
+`)
+	target, err := loadTarget("example.yml", data)
+	assert.NoError(t, err)
+	d := NewDispatch(t.TempDir(), SMTPSettings{})
+	assert.NoError(t, d.AddTarget(target))
+	assert.Equal(t, "local-mta", target.Confirmation.transport.Name())
+
+	target, err = loadTarget("example.yml", []byte("to: [admin@my-site.com]\nconfirmation: {output: chat}\n"))
+	assert.NoError(t, err)
+	assert.EqualError(t, d.AddTarget(target), "confirmation output 'chat' is not an smtp or sendmail output")
+}
+
+func TestConfirmationFailure(t *testing.T) {
+	target, err := loadTarget("example.yml", []byte("to: [admin@my-site.com]\nconfirmation: {}\n"))
+	assert.NoError(t, err)
+	d := NewDispatch(t.TempDir(), SMTPSettings{})
+	assert.NoError(t, d.AddTarget(target))
+	target = d.nameMap["example.yml"]
+	target.transports = []Transport{&testTransport{name: "test"}}
+	confirmations := &testTransport{name: "smtp", err: errors.New("down")}
+	target.Confirmation.transport = confirmations
+
+	// a confirmation that failed does not hold off the next one
+	request := DispatchRequest{"email": "jo@anywhere.com"}
+	for i := 0; i < 2; i++ {
+		_, err = d.SendTarget(target, request)
+		assert.NoError(t, err)
+		assert.NoError(t, d.Wait(context.Background()))
+	}
+	assert.Len(t, confirmations.messages, 2)
+
+	confirmations.err = nil
+	for i := 0; i < 2; i++ {
+		_, err = d.SendTarget(target, request)
+		assert.NoError(t, err)
+		assert.NoError(t, d.Wait(context.Background()))
+	}
+	assert.Len(t, confirmations.messages, 3)
+}
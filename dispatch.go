@@ -2,13 +2,19 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/x509"
 	"errors"
 	"fmt"
+	htmltemplate "html/template"
 	"io/ioutil"
+	"net/mail"
 	"path"
 	"path/filepath"
 	"reflect"
+	"sync"
 	"text/template"
+	"time"
 
 	"github.com/Masterminds/sprig/v3"
 	log "github.com/sirupsen/logrus"
@@ -24,22 +30,44 @@ type DispatchRequest map[string]string
 // DispatchRequest is values provided in headers
 type DispatchHeaders map[string]string
 
+// ErrDeliveryFailed is returned when a message could not be sent to any output
+var ErrDeliveryFailed = errors.New("message could not be delivered")
+
 // Dispatch is the central point for the dispatches
 type Dispatch struct {
 	dispatchMap     DispatchMap
-	smtpSettings    SMTPSettings
+	nameMap         map[string]DispatchTarget
+	certMap         map[string]DispatchTarget
+	relays          *Relays
 	messageTemplate *template.Template
+	htmlTemplate    *htmltemplate.Template
+	jwtValidator    *JWTValidator
+	confirmations   *confirmationThrottle
+	threads         *senderThreads
+	messageIDDomain string
+	timeSettings    TimeSettings
+	loadErrors      int
+	pending         sync.WaitGroup
 }
 
 // NewDispatch create a new dispatch
 func NewDispatch(targetDir string, smtpSettings SMTPSettings) *Dispatch {
 	d := new(Dispatch)
 	d.dispatchMap = make(DispatchMap)
-	d.smtpSettings = smtpSettings
+	d.nameMap = make(map[string]DispatchTarget)
+	d.certMap = make(map[string]DispatchTarget)
+	d.relays = newRelays(smtpSettings)
+	d.confirmations = newConfirmationThrottle()
+	d.threads = newSenderThreads()
+	d.timeSettings = TimeSettings{Zone: "UTC", location: time.UTC}
+	d.messageIDDomain = smtpSettings.MessageIDDomain
+	if len(d.messageIDDomain) == 0 {
+		d.messageIDDomain = getDefaultMessageIDDomain()
+	}
 	msg := `
 {{ printf "%-12s" "Timestamp:"}}{{ index . "timestamp" }}
 {{ range $key, $value := . -}}
-{{ if eq $key "message" "auth-token" "timestamp" }}{{ else -}}
+{{ if eq $key "message" "auth-token" "timestamp" "timestamp_iso" }}{{ else -}}
 {{title $key | printf "%s:" | printf "%-12s"}}{{$value}}
 {{ end }}{{ end -}}
 -----------------------------------------------------------
@@ -47,6 +75,7 @@ func NewDispatch(targetDir string, smtpSettings SMTPSettings) *Dispatch {
 `
 
 	d.messageTemplate = template.Must(template.New("request").Funcs(sprig.TxtFuncMap()).Parse(msg))
+	d.htmlTemplate = htmltemplate.Must(htmltemplate.New("request").Funcs(htmlFuncMap()).Parse(defaultHTMLTemplate))
 	d.LoadTargets(targetDir)
 	return d
 }
@@ -64,35 +93,120 @@ func (d *Dispatch) LoadTargets(targetDir string) {
 		data, err := ioutil.ReadFile(target)
 		if err != nil {
 			log.Errorf("error: could not load %s: %v", target, err)
+			d.loadErrors++
 			continue
 		}
 		targetConf, err := loadTarget(target, data)
 		if err != nil {
 			log.Errorf("error: parsing target %s: %v", target, err)
+			d.loadErrors++
 			continue
 		}
 
-		if len(targetConf.To) == 0 {
-			log.Errorf("error: target %s does not have a destination, skipping", targetConf.Name)
+		if err := d.AddTarget(targetConf); err != nil {
+			log.Errorf("error: target %s: %v, skipping", targetConf.Name, err)
+			d.loadErrors++
 			continue
 		}
-
-		d.dispatchMap[targetConf.AuthToken] = targetConf
-		log.Infof("loaded target %s:%s", targetConf.Name, targetConf.AuthToken)
+		log.Infof("loaded target %s", targetConf.Name)
 	}
 }
 
+// LoadErrors returns how many targets could not be loaded
+func (d *Dispatch) LoadErrors() int {
+	return d.loadErrors
+}
+
 // AddTarget adds a target to the dispatch map
-func (d *Dispatch) AddTarget(target DispatchTarget) {
-	d.dispatchMap[target.AuthToken] = target
+func (d *Dispatch) AddTarget(target DispatchTarget) error {
+	transports, err := newTransports(d, target)
+	if err != nil {
+		return err
+	}
+	target.transports = transports
+	if err := resolveRouteOutputs(target.Routes, transports); err != nil {
+		return err
+	}
+	if target.Confirmation != nil {
+		if err := target.Confirmation.resolveOutput(target, transports); err != nil {
+			return err
+		}
+	}
+
+	// targets without a token can only be reached through other auth methods
+	if len(target.AuthToken) > 0 {
+		d.dispatchMap[target.AuthToken] = target
+	}
+	d.nameMap[target.Name] = target
+	for _, name := range target.ClientNames {
+		d.certMap[name] = target
+	}
+	return nil
 }
 
-// Send formats and sends the message
-func (d *Dispatch) Send(request DispatchRequest) error {
-	target, found := d.dispatchMap[request["auth-token"]]
+// SetTimeSettings changes how timestamps are formatted, targets can override
+// any of the settings
+func (d *Dispatch) SetTimeSettings(settings TimeSettings) {
+	d.timeSettings = d.timeSettings.override(settings)
+}
+
+// SetJWTValidator enables bearer token authentication
+func (d *Dispatch) SetJWTValidator(v *JWTValidator) {
+	d.jwtValidator = v
+}
+
+// AuthenticateJWT validates a bearer token and returns the target it maps too
+// along with any claims exposed as request fields
+func (d *Dispatch) AuthenticateJWT(raw string) (DispatchTarget, DispatchRequest, error) {
+	if d.jwtValidator == nil {
+		return DispatchTarget{}, nil, errors.New("bearer authentication is not enabled")
+	}
+	name, fields, err := d.jwtValidator.Validate(raw)
+	if err != nil {
+		log.Debugf("jwt validation failed: %v", err)
+		return DispatchTarget{}, nil, errors.New("authentication is not valid")
+	}
+	target, found := d.nameMap[name]
 	if !found {
-		return errors.New("authentication is not valid")
+		log.Debugf("jwt target '%s' does not exist", name)
+		return DispatchTarget{}, nil, errors.New("authentication is not valid")
+	}
+	return target, fields, nil
+}
+
+// AuthenticateCert returns the target mapped to a verified client certificate
+func (d *Dispatch) AuthenticateCert(cert *x509.Certificate) (DispatchTarget, bool) {
+	for _, name := range getCertNames(cert) {
+		if target, found := d.certMap[name]; found {
+			log.Debugf("client certificate '%s' matched target %s", name, target.Name)
+			return target, true
+		}
+	}
+	return DispatchTarget{}, false
+}
+
+// Send formats and sends the message to the target matching the auth-token
+func (d *Dispatch) Send(request DispatchRequest) (string, error) {
+	token := request["auth-token"]
+	target, found := d.dispatchMap[token]
+	if len(token) == 0 || !found {
+		return "", errors.New("authentication is not valid")
 	}
+	return d.SendTarget(target, request)
+}
+
+// SendTarget formats and sends the message to an authenticated target. It
+// returns the Message-ID of the message.
+func (d *Dispatch) SendTarget(target DispatchTarget, request DispatchRequest) (string, error) {
+	received, err := time.Parse(time.RFC3339Nano, request["timestamp_iso"])
+	if err != nil {
+		received = time.Now()
+	}
+	times := d.timeSettings.override(target.Time)
+	request = DispatchRequest(mergeRequests(DispatchRequest{
+		"timestamp":     times.formatTime(received),
+		"timestamp_iso": times.isoTime(received),
+	}, request))
 
 	r := mergeRequests(request, target.Defaults)
 
@@ -106,24 +220,219 @@ func (d *Dispatch) Send(request DispatchRequest) error {
 	// if 'from' field is black, email package will fill in a default
 	email.FromAddress = target.From
 	email.ToAddressList = target.To
+	email.CcAddressList = target.Cc
+	email.BccAddressList = target.Bcc
+	email.ReplyTo = target.ReplyTo
+	if len(email.ReplyTo) == 0 {
+		email.ReplyTo = getReplyTo(r["email"], r["name"])
+	}
 	email.Subject = fmt.Sprintf("[dispatch] %s%s", target.Name, subject)
 
+	email.Fields = map[string]string{}
+	for key, value := range r {
+		if key != "auth-token" {
+			email.Fields[key] = value
+		}
+	}
+
+	if target.subjectTemplate != nil {
+		var subjectBuffer bytes.Buffer
+		if err := target.subjectTemplate.Execute(&subjectBuffer, email.Fields); err != nil {
+			log.Errorf("error: target %s subject template: %v", target.Name, err)
+		} else {
+			email.Subject = subjectBuffer.String()
+		}
+	}
+
+	if route := target.route(r); route != nil {
+		log.Debugf("target %s: using route %s", target.Name, route.Name)
+		if len(route.To)+len(route.Cc)+len(route.Bcc) > 0 {
+			email.ToAddressList = route.To
+			email.CcAddressList = route.Cc
+			email.BccAddressList = route.Bcc
+		}
+		if len(route.SubjectPrefix) > 0 {
+			email.Subject = fmt.Sprintf("%s %s", route.SubjectPrefix, email.Subject)
+		}
+		target.transports = route.transports
+	}
+	// the subject is made from client input, make sure it can not add headers
+	email.Subject = sanitizeSubject(email.Subject)
+
+	if len(target.headerTemplates) > 0 {
+		headers, err := renderHeaders(target.headerTemplates, email.Fields)
+		if err != nil {
+			log.Errorf("error: target %s %v", target.Name, err)
+		}
+		email.Headers = headers
+	}
+	email.MessageID = newMessageID(d.messageIDDomain)
+	var threadSender string
+	if target.Threading {
+		if sender, err := mail.ParseAddress(r["email"]); err == nil {
+			threadSender = sender.Address
+			email.References = d.threads.references(target.Name, threadSender)
+			if len(email.References) > 0 {
+				email.InReplyTo = email.References[len(email.References)-1]
+			}
+		}
+	}
+
+	textTemplate := d.messageTemplate
+	if target.textTemplate != nil {
+		textTemplate = target.textTemplate
+	}
 	var msgBuffer bytes.Buffer
-	d.messageTemplate.Execute(&msgBuffer, request)
+	if err := textTemplate.Execute(&msgBuffer, request); err != nil {
+		log.Errorf("error: target %s text template: %v", target.Name, err)
+	}
 	email.TextMessage = msgBuffer.String()
 
-	log.Infof("sending message: {AuthToken:%s Name:%s}", request["auth-token"], request["name"])
-	sendMessage(email, d.smtpSettings)
-	return nil
+	htmlTemplate := target.htmlTemplate
+	if htmlTemplate == nil && target.Markdown {
+		htmlTemplate = d.htmlTemplate
+	}
+	if htmlTemplate != nil {
+		var htmlBuffer bytes.Buffer
+		if err := htmlTemplate.Execute(&htmlBuffer, request); err != nil {
+			log.Errorf("error: target %s html template: %v", target.Name, err)
+		}
+		email.HTMLMessage = htmlBuffer.String()
+	}
+
+	log.Infof("sending message: {Target:%s Name:%s}", target.Name, request["name"])
+	results := d.deliver(target, email)
+
+	delivered := 0
+	for _, result := range results {
+		if result.Err != nil {
+			log.Errorf("error: target %s output %s failed: %v", target.Name, result.Output, result.Err)
+			continue
+		}
+		log.Infof("delivered message: {Target:%s Output:%s}", target.Name, result.Output)
+		delivered++
+	}
+	if delivered == 0 {
+		return "", ErrDeliveryFailed
+	}
+	// only messages that went out can be replied to
+	if len(threadSender) > 0 {
+		d.threads.add(target.Name, threadSender, email.MessageID)
+	}
+
+	if target.Confirmation != nil {
+		d.pending.Add(1)
+		go func() {
+			defer d.pending.Done()
+			d.confirm(target, email)
+		}()
+	}
+	return email.MessageID, nil
+}
+
+// deliver sends the message to every output of the target at once
+func (d *Dispatch) deliver(target DispatchTarget, message Message) []DeliveryResult {
+	d.pending.Add(1)
+	defer d.pending.Done()
+
+	results := make([]DeliveryResult, len(target.transports))
+	var wg sync.WaitGroup
+	for i, transport := range target.transports {
+		wg.Add(1)
+		go func(i int, transport Transport) {
+			defer wg.Done()
+			err := transport.Send(context.Background(), message)
+			results[i] = DeliveryResult{transport.Name(), err}
+		}(i, transport)
+	}
+	wg.Wait()
+	return results
+}
+
+// CheckOutputs runs the health check of every target output
+func (d *Dispatch) CheckOutputs(ctx context.Context) map[string]error {
+	results := map[string]error{}
+	for _, target := range d.nameMap {
+		for _, transport := range target.transports {
+			name := fmt.Sprintf("%s/%s", target.Name, transport.Name())
+			results[name] = transport.Check(ctx)
+		}
+	}
+	return results
+}
+
+// Close closes any connections kept open by the outputs
+func (d *Dispatch) Close() {
+	d.relays.Close()
+}
+
+// Wait blocks until all pending deliveries are done or the context expires
+func (d *Dispatch) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		d.pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 // DispatchTarget is a target to send too
 type DispatchTarget struct {
-	AuthToken string            `yaml:"auth-token"`
-	From      string            `yaml:"from"`
-	To        []string          `yaml:"to"`
-	Name      string            `yaml:"name"`
-	Defaults  map[string]string `yaml:"defaults"`
+	AuthToken   string            `yaml:"auth-token"`
+	ClientNames []string          `yaml:"client-names"`
+	From        string            `yaml:"from"`
+	To          []string          `yaml:"to"`
+	Cc          []string          `yaml:"cc"`
+	Bcc         []string          `yaml:"bcc"`
+	ReplyTo     string            `yaml:"reply-to"`
+	Name        string            `yaml:"name"`
+	Defaults    map[string]string `yaml:"defaults"`
+	Outputs     []OutputConfig    `yaml:"outputs"`
+	Templates   TargetTemplates   `yaml:"templates"`
+	// Confirmation is sent back to the submitter when set
+	Confirmation *TargetConfirmation `yaml:"confirmation"`
+	// Routes pick the recipients and outputs from the request fields
+	Routes []TargetRoute `yaml:"routes"`
+	// Headers are added to emails, the values are templates
+	Headers map[string]string `yaml:"headers"`
+	// Threading replies to the earlier messages from the same sender
+	Threading bool `yaml:"threading"`
+	// Markdown renders the message field as markdown in the html part
+	Markdown bool `yaml:"markdown"`
+	// Time overrides the global timestamp settings
+	Time TimeSettings `yaml:"time"`
+
+	transports      []Transport
+	subjectTemplate *template.Template
+	textTemplate    *template.Template
+	htmlTemplate    *htmltemplate.Template
+	headerTemplates map[string]*template.Template
+}
+
+// hasRecipients returns true if the target, or one of its routes, has anyone
+// to email
+func (t DispatchTarget) hasRecipients() bool {
+	if len(t.To)+len(t.Cc)+len(t.Bcc) > 0 {
+		return true
+	}
+	for _, route := range t.Routes {
+		if len(route.To)+len(route.Cc)+len(route.Bcc) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// TargetTemplates override the default message templates of a target
+type TargetTemplates struct {
+	Subject string `yaml:"subject"`
+	Text    string `yaml:"text"`
+	HTML    string `yaml:"html"`
 }
 
 func getTargetConfigList(targetDir string) (target []string, err error) {
@@ -146,6 +455,9 @@ func loadTarget(target string, data []byte) (DispatchTarget, error) {
 	if len(t.Name) == 0 {
 		t.Name = path.Base(target)
 	}
+	if err := resolveSecrets(&t.AuthToken); err != nil {
+		return t, err
+	}
 
 	oldTo := make([]string, len(t.To))
 	copy(oldTo, t.To)
@@ -158,6 +470,55 @@ func loadTarget(target string, data []byte) (DispatchTarget, error) {
 		}
 		t.To = append(t.To, fAddr)
 	}
+	if t.Cc, err = formatEmailList(t.Cc); err != nil {
+		return t, fmt.Errorf("cc: %v", err)
+	}
+	if t.Bcc, err = formatEmailList(t.Bcc); err != nil {
+		return t, fmt.Errorf("bcc: %v", err)
+	}
+	if len(t.ReplyTo) > 0 {
+		if t.ReplyTo, err = FormatEmail(t.ReplyTo); err != nil {
+			return t, fmt.Errorf("reply-to: %v", err)
+		}
+	}
+
+	if err := t.Time.prepare(); err != nil {
+		return t, fmt.Errorf("time: %v", err)
+	}
+	if err := prepareRoutes(t.Routes); err != nil {
+		return t, err
+	}
+	if len(t.Routes) > 0 && !t.hasFallback() {
+		return t, errors.New("routes: submissions matching no route have no recipients, set the target recipients or add a route without conditions last")
+	}
+	if t.headerTemplates, err = parseHeaderTemplates(t.Headers); err != nil {
+		return t, err
+	}
+
+	if len(t.Templates.Subject) > 0 {
+		t.subjectTemplate, err = template.New("subject").Funcs(sprig.TxtFuncMap()).Parse(t.Templates.Subject)
+		if err != nil {
+			return t, err
+		}
+	}
+	if len(t.Templates.Text) > 0 {
+		t.textTemplate, err = template.New("text").Funcs(sprig.TxtFuncMap()).Parse(t.Templates.Text)
+		if err != nil {
+			return t, err
+		}
+	}
+	if len(t.Templates.HTML) > 0 {
+		t.htmlTemplate, err = htmltemplate.New("html").Funcs(htmlFuncMap()).Parse(t.Templates.HTML)
+		if err != nil {
+			return t, err
+		}
+	}
+
+	if t.Confirmation != nil {
+		if err := t.Confirmation.prepare(t); err != nil {
+			return t, fmt.Errorf("confirmation: %v", err)
+		}
+	}
 
 	log.Debugf("target=%+v", t)
 	return t, nil
@@ -2,7 +2,13 @@ package main
 
 import "testing"
 
-import "github.com/stretchr/testify/assert"
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
 
 func TestMergeRequests(t *testing.T) {
 	p := DispatchRequest{}
@@ -21,3 +27,109 @@ func TestMergeRequests(t *testing.T) {
 	assert.EqualValues(t, expected, m)
 
 }
+
+func TestDispatchWait(t *testing.T) {
+	d := NewDispatch(t.TempDir(), SMTPSettings{})
+	assert.NoError(t, d.Wait(context.Background()))
+
+	d.pending.Add(1)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Error(t, d.Wait(ctx))
+	d.pending.Done()
+}
+
+func TestTargetTemplates(t *testing.T) {
+	data := []byte(`
+name: example
+to: [admin@my-site.com]
+templates:
+  text: "From {{ .name }}"
+  html: "<p>From {{ .name }}</p>"
+`)
+	target, err := loadTarget("example.yml", data)
+	assert.NoError(t, err)
+
+	transport := &testTransport{name: "test"}
+	target.transports = []Transport{transport}
+	d := NewDispatch(t.TempDir(), SMTPSettings{})
+	_, err = d.SendTarget(target, DispatchRequest{"name": "<anon>"})
+	assert.NoError(t, err)
+	assert.Equal(t, "From <anon>", transport.messages[0].TextMessage)
+	assert.Equal(t, "<p>From &lt;anon&gt;</p>", transport.messages[0].HTMLMessage)
+
+	_, err = loadTarget("example.yml", []byte(`templates: {text: "{{ .name "}`))
+	assert.Error(t, err)
+}
+
+func TestTargetRecipients(t *testing.T) {
+	data := []byte(`
+name: example
+to: [admin@my-site.com]
+cc: ["Support <support@my-site.com>"]
+bcc: [archive@my-site.com]
+`)
+	target, err := loadTarget("example.yml", data)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"\"Support\" <support@my-site.com>"}, target.Cc)
+
+	transport := &testTransport{name: "test"}
+	target.transports = []Transport{transport}
+	d := NewDispatch(t.TempDir(), SMTPSettings{})
+	_, err = d.SendTarget(target, DispatchRequest{"name": "Anon Ymous", "email": "anon@my-site.com"})
+	assert.NoError(t, err)
+	message := transport.messages[0]
+	assert.Equal(t, "\"Anon Ymous\" <anon@my-site.com>", message.ReplyTo)
+	assert.Equal(t, []string{"archive@my-site.com"}, message.BccAddressList)
+
+	msg, err := buildMessage(message)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"\"Anon Ymous\" <anon@my-site.com>"}, msg.GetHeader("Reply-To"))
+	assert.Equal(t, []string{"\"Support\" <support@my-site.com>"}, msg.GetHeader("Cc"))
+
+	target.ReplyTo = "forms@my-site.com"
+	_, err = d.SendTarget(target, DispatchRequest{"email": "anon@my-site.com"})
+	assert.NoError(t, err)
+	assert.Equal(t, "forms@my-site.com", transport.messages[1].ReplyTo)
+
+	_, err = loadTarget("example.yml", []byte("to: [admin@my-site.com]\nbcc: [not-an-email]\n"))
+	assert.Error(t, err)
+}
+
+func TestTargetSubject(t *testing.T) {
+	target, err := loadTarget("example.yml", []byte(`
+name: example
+to: [admin@my-site.com]
+templates:
+  subject: "{{ .department | upper }}: {{ .subject }}"
+`))
+	assert.NoError(t, err)
+
+	transport := &testTransport{name: "test"}
+	target.transports = []Transport{transport}
+	d := NewDispatch(t.TempDir(), SMTPSettings{})
+	request := DispatchRequest{"department": "sales", "subject": "hi\r\nBcc: victim@anywhere.com"}
+	_, err = d.SendTarget(target, request)
+	assert.NoError(t, err)
+	message := transport.messages[0]
+	assert.Equal(t, "SALES: hi Bcc: victim@anywhere.com", message.Subject)
+
+	msg, err := buildMessage(message)
+	assert.NoError(t, err)
+	assert.Empty(t, msg.GetHeader("Bcc"))
+
+	_, err = loadTarget("example.yml", []byte(`templates: {subject: "{{ .name "}`))
+	assert.Error(t, err)
+}
+
+func TestSanitizeSubject(t *testing.T) {
+	assert.Equal(t, "a b c", sanitizeSubject(" a\r\nb\x00\tc "))
+	assert.Equal(t, "caf", sanitizeSubject("caf\xe9"))
+	long := sanitizeSubject(strings.Repeat("é", maxSubjectLength+10))
+	assert.Equal(t, maxSubjectLength, len([]rune(long)))
+
+	msg, err := buildMessage(Message{ToAddressList: []string{"admin@my-site.com"},
+		Subject: "Grüße\nX-Injected: yes", TextMessage: "hi"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"=?UTF-8?q?Gr=C3=BC=C3=9Fe_X-Injected:_yes?="}, msg.GetHeader("Subject"))
+}
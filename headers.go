@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/textproto"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/Masterminds/sprig/v3"
+)
+
+// reservedHeaders are set by dispatch and can not be overridden by a target
+var reservedHeaders = []string{
+	"Bcc", "Cc", "Content-Transfer-Encoding", "Content-Type", "Date", "From",
+	"In-Reply-To", "Message-Id", "Mime-Version", "References", "Reply-To",
+	"Return-Path", "Sender", "Subject", "To",
+}
+
+var headerNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9-]*$`)
+
+// parseHeaderTemplates validates the custom headers of a target and parses
+// their values as templates
+func parseHeaderTemplates(headers map[string]string) (map[string]*template.Template, error) {
+	templates := map[string]*template.Template{}
+	for name, value := range headers {
+		if !headerNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("header '%s' is not a valid name", name)
+		}
+		name = textproto.CanonicalMIMEHeaderKey(name)
+		if contains(reservedHeaders, name) {
+			return nil, fmt.Errorf("header '%s' can not be set by a target", name)
+		}
+		if _, found := templates[name]; found {
+			return nil, fmt.Errorf("header '%s' is defined more than once", name)
+		}
+		tmpl, err := template.New(name).Option("missingkey=zero").Funcs(sprig.TxtFuncMap()).Parse(value)
+		if err != nil {
+			return nil, fmt.Errorf("header '%s': %v", name, err)
+		}
+		templates[name] = tmpl
+	}
+	return templates, nil
+}
+
+// renderHeaders executes the header templates with the request fields,
+// headers that come out empty are left out
+func renderHeaders(templates map[string]*template.Template, fields map[string]string) (map[string]string, error) {
+	headers := map[string]string{}
+	for name, tmpl := range templates {
+		var value bytes.Buffer
+		if err := tmpl.Execute(&value, fields); err != nil {
+			return nil, fmt.Errorf("header '%s': %v", name, err)
+		}
+		if v := sanitizeHeader(value.String()); len(v) > 0 {
+			headers[name] = v
+		}
+	}
+	return headers, nil
+}
+
+// newMessageID returns a unique Message-ID for the domain
+func newMessageID(domain string) string {
+	var random [12]byte
+	rand.Read(random[:])
+	return fmt.Sprintf("<%d.%s@%s>", time.Now().UnixNano(), hex.EncodeToString(random[:]), domain)
+}
+
+// getDefaultMessageIDDomain returns the host name as the Message-ID domain
+func getDefaultMessageIDDomain() string {
+	hostname, err := os.Hostname()
+	if err != nil || len(hostname) == 0 {
+		return "localhost"
+	}
+	return hostname
+}
+
+const (
+	// threadTimeout is how long a sender thread is kept after its last message
+	threadTimeout = 30 * 24 * time.Hour
+	// threadMaxReferences is how many Message-IDs are kept in References, the
+	// first message of the thread is always kept
+	threadMaxReferences = 20
+	// threadMaxSenders limits how many threads are kept in memory
+	threadMaxSenders = 10000
+)
+
+// senderThreads remembers the messages sent for each sender so later
+// submissions can reply to them
+type senderThreads struct {
+	mutex   sync.Mutex
+	threads map[string]*senderThread
+}
+
+type senderThread struct {
+	references []string
+	lastUsed   time.Time
+}
+
+func newSenderThreads() *senderThreads {
+	return &senderThreads{threads: map[string]*senderThread{}}
+}
+
+// references returns the Message-IDs of the earlier messages in the thread
+// of a sender, oldest first
+func (s *senderThreads) references(target string, sender string) []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	thread, found := s.threads[threadKey(target, sender)]
+	if !found || time.Since(thread.lastUsed) > threadTimeout {
+		return nil
+	}
+	references := make([]string, len(thread.references))
+	copy(references, thread.references)
+	return references
+}
+
+// add records a message that was sent to the thread of a sender
+func (s *senderThreads) add(target string, sender string, messageID string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := time.Now()
+	key := threadKey(target, sender)
+	thread, found := s.threads[key]
+	if found && now.Sub(thread.lastUsed) > threadTimeout {
+		found = false
+	}
+	if !found {
+		if len(s.threads) >= threadMaxSenders {
+			s.expire(now)
+		}
+		s.threads[key] = &senderThread{references: []string{messageID}, lastUsed: now}
+		return
+	}
+
+	thread.references = append(thread.references, messageID)
+	if len(thread.references) > threadMaxReferences {
+		thread.references = append(thread.references[:1], thread.references[2:]...)
+	}
+	thread.lastUsed = now
+}
+
+func threadKey(target string, sender string) string {
+	return target + "\x00" + strings.ToLower(sender)
+}
+
+// expire drops the threads that timed out, or the least recently used half
+// when that is not enough
+func (s *senderThreads) expire(now time.Time) {
+	var lastUsed []time.Time
+	for key, thread := range s.threads {
+		if now.Sub(thread.lastUsed) > threadTimeout {
+			delete(s.threads, key)
+			continue
+		}
+		lastUsed = append(lastUsed, thread.lastUsed)
+	}
+	if len(s.threads) < threadMaxSenders {
+		return
+	}
+	sort.Slice(lastUsed, func(i, j int) bool { return lastUsed[i].Before(lastUsed[j]) })
+	cutoff := lastUsed[len(lastUsed)/2]
+	for key, thread := range s.threads {
+		if !thread.lastUsed.After(cutoff) {
+			delete(s.threads, key)
+		}
+	}
+}
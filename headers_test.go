@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTargetHeaders(t *testing.T) {
+	target, err := loadTarget("example.yml", []byte(`
+name: example
+to: [admin@my-site.com]
+headers:
+  x-site: my-site.com
+  List-Id: "{{ .department }} <{{ .department }}.my-site.com>"
+  X-Empty: "{{ .missing }}"
+threading: true
+`))
+	assert.NoError(t, err)
+
+	transport := &testTransport{name: "test"}
+	target.transports = []Transport{transport}
+	d := NewDispatch(t.TempDir(), SMTPSettings{MessageIDDomain: "mail.my-site.com"})
+	request := DispatchRequest{"department": "sales\r\nBcc: victim@anywhere.com", "email": "jo@anywhere.com"}
+	first, err := d.SendTarget(target, request)
+	assert.NoError(t, err)
+	assert.Regexp(t, regexp.MustCompile(`^<\d+\.[0-9a-f]{24}@mail\.my-site\.com>$`), first)
+
+	message := transport.messages[0]
+	assert.Equal(t, first, message.MessageID)
+	assert.Equal(t, map[string]string{
+		"X-Site":  "my-site.com",
+		"List-Id": "sales Bcc: victim@anywhere.com <sales Bcc: victim@anywhere.com.my-site.com>",
+	}, message.Headers)
+	assert.Empty(t, message.InReplyTo)
+
+	msg, err := buildMessage(message)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{first}, msg.GetHeader("Message-ID"))
+	assert.Equal(t, []string{"my-site.com"}, msg.GetHeader("X-Site"))
+	assert.Empty(t, msg.GetHeader("Bcc"))
+
+	second, err := d.SendTarget(target, DispatchRequest{"email": "JO@anywhere.com"})
+	assert.NoError(t, err)
+	third, err := d.SendTarget(target, DispatchRequest{"email": "jo@anywhere.com"})
+	assert.NoError(t, err)
+	assert.Equal(t, first, transport.messages[1].InReplyTo)
+	assert.Equal(t, second, transport.messages[2].InReplyTo)
+	assert.Equal(t, []string{first, second}, transport.messages[2].References)
+	assert.Equal(t, third, transport.messages[2].MessageID)
+
+	msg, err = buildMessage(transport.messages[2])
+	assert.NoError(t, err)
+	assert.Equal(t, []string{first + " " + second}, msg.GetHeader("References"))
+}
+
+func TestHeaderValidation(t *testing.T) {
+	invalid := []string{
+		`headers: {"X Site": a}`,
+		`headers: {"X-Site:": a}`,
+		`headers: {bcc: a}`,
+		`headers: {message-id: a}`,
+		`headers: {X-Site: a, x-site: b}`,
+		`headers: {X-Site: "{{ .a "}`,
+	}
+	for _, data := range invalid {
+		_, err := loadTarget("example.yml", []byte(data))
+		assert.Error(t, err, data)
+	}
+}
+
+func TestSenderThreads(t *testing.T) {
+	threads := newSenderThreads()
+	assert.Nil(t, threads.references("a", "jo@anywhere.com"))
+	threads.add("a", "jo@anywhere.com", "<1>")
+	assert.Nil(t, threads.references("b", "jo@anywhere.com"))
+	for i := 2; i < threadMaxReferences+5; i++ {
+		threads.add("a", "jo@anywhere.com", fmt.Sprintf("<a%d>", i))
+	}
+	references := threads.references("a", "JO@anywhere.com")
+	assert.Len(t, references, threadMaxReferences)
+	assert.Equal(t, "<1>", references[0])
+	assert.Equal(t, fmt.Sprintf("<a%d>", threadMaxReferences+4), references[len(references)-1])
+
+	for i := 0; i < threadMaxSenders; i++ {
+		threads.add("c", fmt.Sprintf("%d@anywhere.com", i), "<c>")
+	}
+	assert.Less(t, len(threads.threads), threadMaxSenders)
+}
+
+func TestThreadingFailedDelivery(t *testing.T) {
+	target, err := loadTarget("example.yml", []byte("to: [admin@my-site.com]\nthreading: true\n"))
+	assert.NoError(t, err)
+	transport := &testTransport{name: "test", err: errors.New("down")}
+	target.transports = []Transport{transport}
+	d := NewDispatch(t.TempDir(), SMTPSettings{})
+
+	// a message that was not delivered is not replied to
+	_, err = d.SendTarget(target, DispatchRequest{"email": "jo@anywhere.com"})
+	assert.Equal(t, ErrDeliveryFailed, err)
+	transport.err = nil
+	first, err := d.SendTarget(target, DispatchRequest{"email": "jo@anywhere.com"})
+	assert.NoError(t, err)
+	_, err = d.SendTarget(target, DispatchRequest{"email": "jo@anywhere.com"})
+	assert.NoError(t, err)
+	if assert.Len(t, transport.messages, 3) {
+		assert.Empty(t, transport.messages[1].InReplyTo)
+		assert.Equal(t, []string{first}, transport.messages[2].References)
+	}
+}
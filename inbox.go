@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	gomail "gopkg.in/gomail.v2"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const inboxPath = "/dev/inbox"
+
+// inboxSize is how many captured messages are kept
+const inboxSize = 500
+
+// Inbox keeps the messages sent while in capture mode so they can be looked
+// at in a browser instead of being delivered
+type Inbox struct {
+	sync.RWMutex
+	size     int
+	lastID   int
+	messages []*CapturedMessage
+}
+
+// CapturedMessage is a message stored in the inbox
+type CapturedMessage struct {
+	ID        int       `json:"id"`
+	MessageID string    `json:"message_id,omitempty"`
+	Time      time.Time `json:"time"`
+	From      string    `json:"from"`
+	To        []string  `json:"to"`
+	Subject   string    `json:"subject"`
+	Text      string    `json:"text,omitempty"`
+	HTML      string    `json:"html,omitempty"`
+	Raw       string    `json:"-"`
+}
+
+// NewInbox creates an inbox that keeps at most size messages
+func NewInbox(size int) *Inbox {
+	return &Inbox{size: size}
+}
+
+// Capture stores a message, dropping the oldest one when the inbox is full
+func (i *Inbox) Capture(message Message, msg *gomail.Message) error {
+	var raw bytes.Buffer
+	if _, err := msg.WriteTo(&raw); err != nil {
+		return err
+	}
+
+	i.Lock()
+	defer i.Unlock()
+	i.lastID++
+	i.messages = append(i.messages, &CapturedMessage{
+		ID:        i.lastID,
+		MessageID: message.MessageID,
+		Time:      time.Now(),
+		From:      strings.Join(msg.GetHeader("From"), ", "),
+		To:        msg.GetHeader("To"),
+		Subject:   message.Subject,
+		Text:      message.TextMessage,
+		HTML:      message.HTMLMessage,
+		Raw:       raw.String(),
+	})
+	if len(i.messages) > i.size {
+		i.messages = i.messages[len(i.messages)-i.size:]
+	}
+	log.Infof("captured message %d to %s", i.lastID, strings.Join(msg.GetHeader("To"), ", "))
+	return nil
+}
+
+// Messages returns the captured messages, newest first
+func (i *Inbox) Messages() []*CapturedMessage {
+	i.RLock()
+	defer i.RUnlock()
+	messages := make([]*CapturedMessage, len(i.messages))
+	for n, message := range i.messages {
+		messages[len(i.messages)-1-n] = message
+	}
+	return messages
+}
+
+// Get returns a captured message by id
+func (i *Inbox) Get(id int) *CapturedMessage {
+	i.RLock()
+	defer i.RUnlock()
+	for _, message := range i.messages {
+		if message.ID == id {
+			return message
+		}
+	}
+	return nil
+}
+
+// Clear removes all of the captured messages
+func (i *Inbox) Clear() {
+	i.Lock()
+	defer i.Unlock()
+	i.messages = nil
+}
+
+// ServeHTTP serves the inbox page and api:
+//
+//	GET    /dev/inbox                        the inbox page
+//	GET    /dev/inbox/api/messages           list the messages
+//	DELETE /dev/inbox/api/messages           clear the inbox
+//	GET    /dev/inbox/api/messages/{id}      a message with its bodies
+//	GET    /dev/inbox/messages/{id}/html     the rendered html body
+//	GET    /dev/inbox/messages/{id}/text     the text body
+//	GET    /dev/inbox/messages/{id}/raw      the message source
+func (i *Inbox) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// the page uses relative links, so it needs the trailing slash
+	if r.URL.Path == inboxPath {
+		http.Redirect(w, r, inboxPath+"/", http.StatusMovedPermanently)
+		return
+	}
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, inboxPath), "/")
+	parts := strings.Split(path, "/")
+
+	switch {
+	case path == "" && r.Method == "GET":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		inboxPage.Execute(w, i.Messages())
+	case path == "api/messages" && r.Method == "GET":
+		list := []CapturedMessage{}
+		for _, message := range i.Messages() {
+			summary := *message
+			summary.Text, summary.HTML = "", ""
+			list = append(list, summary)
+		}
+		respondJSON(w, list)
+	case path == "api/messages" && r.Method == "DELETE":
+		i.Clear()
+		respondJSON(w, map[string]string{"status": "success"})
+	case len(parts) == 3 && parts[0] == "api" && parts[1] == "messages" && r.Method == "GET":
+		if message := i.lookup(w, r, parts[2]); message != nil {
+			respondJSON(w, message)
+		}
+	case len(parts) == 3 && parts[0] == "messages" && r.Method == "GET":
+		message := i.lookup(w, r, parts[1])
+		if message == nil {
+			return
+		}
+		switch parts[2] {
+		case "html":
+			// captured html is untrusted, never let it run scripts on this origin
+			w.Header().Set("Content-Security-Policy", "sandbox")
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Write([]byte(message.HTML))
+		case "text":
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Write([]byte(message.Text))
+		case "raw":
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Write([]byte(message.Raw))
+		default:
+			respondError(w, r, 404, "page not found")
+		}
+	default:
+		respondError(w, r, 404, "page not found")
+	}
+}
+
+func (i *Inbox) lookup(w http.ResponseWriter, r *http.Request, id string) *CapturedMessage {
+	n, err := strconv.Atoi(id)
+	if err == nil {
+		if message := i.Get(n); message != nil {
+			return message
+		}
+	}
+	respondError(w, r, 404, "message not found")
+	return nil
+}
+
+func respondJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+var inboxPage = template.Must(template.New("inbox").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>dispatch inbox</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; width: 100%; }
+th, td { text-align: left; padding: .4em .8em; border-bottom: 1px solid #ddd; }
+iframe { width: 100%; height: 28em; border: 1px solid #ddd; margin-top: 1em; }
+</style>
+</head>
+<body>
+<h1>dispatch inbox</h1>
+<p>Messages are captured instead of being sent. <button id="clear">Clear inbox</button></p>
+<table>
+<tr><th>Time</th><th>From</th><th>To</th><th>Subject</th><th></th></tr>
+{{- range . }}
+<tr>
+<td>{{ .Time.Format "Jan 02 15:04:05" }}</td>
+<td>{{ .From }}</td>
+<td>{{ range $n, $to := .To }}{{ if $n }}, {{ end }}{{ $to }}{{ end }}</td>
+<td>{{ .Subject }}</td>
+<td>
+{{- if .HTML }}<a href="messages/{{ .ID }}/html" target="preview">html</a> {{ end -}}
+<a href="messages/{{ .ID }}/text" target="preview">text</a>
+<a href="messages/{{ .ID }}/raw" target="preview">raw</a>
+</td>
+</tr>
+{{- else }}
+<tr><td colspan="5">No messages yet</td></tr>
+{{- end }}
+</table>
+<iframe name="preview" sandbox></iframe>
+<script>
+document.getElementById("clear").onclick = function() {
+  fetch("api/messages", {method: "DELETE"}).then(function() { location.reload(); });
+};
+</script>
+</body>
+</html>
+`))
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInbox(t *testing.T) {
+	inbox := NewInbox(2)
+	relays := newRelays(SMTPSettings{Inbox: inbox})
+	for _, subject := range []string{"first", "second", "third"} {
+		err := sendMessage(context.Background(), Message{
+			FromAddress:   "dispatch@my-site.com",
+			ToAddressList: []string{"admin@my-site.com"},
+			Subject:       subject,
+			TextMessage:   "Hello",
+			HTMLMessage:   "<p>Hello</p>",
+		}, relays, nil)
+		assert.NoError(t, err)
+	}
+
+	messages := inbox.Messages()
+	assert.Len(t, messages, 2)
+	assert.Equal(t, "third", messages[0].Subject)
+	assert.Equal(t, []string{"admin@my-site.com"}, messages[0].To)
+	assert.Contains(t, messages[0].Raw, "Subject: third\r\n")
+
+	w := httptest.NewRecorder()
+	inbox.ServeHTTP(w, httptest.NewRequest("GET", "/dev/inbox/api/messages", nil))
+	var list []CapturedMessage
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&list))
+	assert.Len(t, list, 2)
+	assert.Empty(t, list[0].HTML)
+
+	w = httptest.NewRecorder()
+	inbox.ServeHTTP(w, httptest.NewRequest("GET", "/dev/inbox/messages/3/html", nil))
+	assert.Equal(t, "<p>Hello</p>", w.Body.String())
+	assert.Equal(t, "sandbox", w.Header().Get("Content-Security-Policy"))
+
+	w = httptest.NewRecorder()
+	inbox.ServeHTTP(w, httptest.NewRequest("GET", "/dev/inbox/messages/1/raw", nil))
+	assert.Equal(t, 404, w.Code)
+
+	w = httptest.NewRecorder()
+	inbox.ServeHTTP(w, httptest.NewRequest("DELETE", "/dev/inbox/api/messages", nil))
+	assert.Equal(t, 200, w.Code)
+	assert.Empty(t, inbox.Messages())
+}
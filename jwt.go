@@ -0,0 +1,279 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+	log "github.com/sirupsen/logrus"
+)
+
+// JWTSettings defines how bearer tokens are validated
+type JWTSettings struct {
+	Keys        []JWTKeySettings `mapstructure:"keys"`
+	JWKSFile    string           `mapstructure:"jwks_file"`
+	TargetClaim string           `mapstructure:"target_claim"`
+	Claims      []string         `mapstructure:"claims"`
+	Issuer      string           `mapstructure:"issuer"`
+	Audience    string           `mapstructure:"audience"`
+}
+
+// JWTKeySettings defines a single key used to verify bearer tokens
+type JWTKeySettings struct {
+	ID        string `mapstructure:"kid"`
+	Algorithm string `mapstructure:"alg"`
+	Secret    string `mapstructure:"secret"`
+	File      string `mapstructure:"file"`
+}
+
+// JWTValidator validates bearer tokens and maps them to a target
+type JWTValidator struct {
+	keys        []jwtKey
+	targetClaim string
+	claims      []string
+	parser      *jwt.Parser
+}
+
+type jwtKey struct {
+	id        string
+	algorithm string
+	key       interface{}
+}
+
+var jwtAlgorithms = []string{"HS256", "RS256", "ES256"}
+
+// NewJWTValidator creates a validator from the given settings
+func NewJWTValidator(settings JWTSettings) (*JWTValidator, error) {
+	v := new(JWTValidator)
+	v.targetClaim = settings.TargetClaim
+	if len(v.targetClaim) == 0 {
+		v.targetClaim = "sub"
+	}
+	v.claims = settings.Claims
+
+	for _, k := range settings.Keys {
+		key, err := loadJWTKey(k)
+		if err != nil {
+			return nil, err
+		}
+		v.keys = append(v.keys, key)
+	}
+
+	if len(settings.JWKSFile) > 0 {
+		data, err := ioutil.ReadFile(settings.JWKSFile)
+		if err != nil {
+			return nil, err
+		}
+		keys, err := parseJWKS(data)
+		if err != nil {
+			return nil, fmt.Errorf("jwks %s: %v", settings.JWKSFile, err)
+		}
+		v.keys = append(v.keys, keys...)
+	}
+
+	if len(v.keys) == 0 {
+		return nil, errors.New("no jwt keys configured")
+	}
+
+	opts := []jwt.ParserOption{
+		jwt.WithValidMethods(jwtAlgorithms),
+		jwt.WithExpirationRequired(),
+	}
+	if len(settings.Issuer) > 0 {
+		opts = append(opts, jwt.WithIssuer(settings.Issuer))
+	}
+	if len(settings.Audience) > 0 {
+		opts = append(opts, jwt.WithAudience(settings.Audience))
+	}
+	v.parser = jwt.NewParser(opts...)
+
+	return v, nil
+}
+
+// Validate verifies the raw token and returns the target name and any
+// exposed claims as request fields
+func (v *JWTValidator) Validate(raw string) (string, DispatchRequest, error) {
+	claims := jwt.MapClaims{}
+	_, err := v.parser.ParseWithClaims(raw, claims, v.keyFunc)
+	if err != nil {
+		return "", nil, err
+	}
+
+	targetName := claimString(claims[v.targetClaim])
+	if len(targetName) == 0 {
+		return "", nil, fmt.Errorf("claim '%s' missing", v.targetClaim)
+	}
+
+	fields := DispatchRequest{}
+	for _, name := range v.claims {
+		if value, ok := claims[name]; ok {
+			fields[strings.ToLower(name)] = claimString(value)
+		}
+	}
+	return targetName, fields, nil
+}
+
+func (v *JWTValidator) keyFunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	keySet := jwt.VerificationKeySet{}
+	for _, k := range v.keys {
+		if k.algorithm != token.Method.Alg() {
+			continue
+		}
+		if len(kid) > 0 && len(k.id) > 0 && k.id != kid {
+			continue
+		}
+		keySet.Keys = append(keySet.Keys, k.key)
+	}
+	if len(keySet.Keys) == 0 {
+		return nil, fmt.Errorf("no key found for alg=%s kid=%s", token.Method.Alg(), kid)
+	}
+	return keySet, nil
+}
+
+func loadJWTKey(settings JWTKeySettings) (jwtKey, error) {
+	k := jwtKey{id: settings.ID, algorithm: strings.ToUpper(settings.Algorithm)}
+	var err error
+	switch k.algorithm {
+	case "HS256":
+		if len(settings.Secret) == 0 {
+			return k, errors.New("jwt key HS256 requires a secret")
+		}
+		k.key = []byte(settings.Secret)
+	case "RS256", "ES256":
+		if len(settings.File) == 0 {
+			return k, fmt.Errorf("jwt key %s requires a file", k.algorithm)
+		}
+		var data []byte
+		data, err = ioutil.ReadFile(settings.File)
+		if err != nil {
+			return k, err
+		}
+		if k.algorithm == "RS256" {
+			k.key, err = jwt.ParseRSAPublicKeyFromPEM(data)
+		} else {
+			k.key, err = jwt.ParseECPublicKeyFromPEM(data)
+		}
+	default:
+		err = fmt.Errorf("jwt algorithm '%s' is not supported", settings.Algorithm)
+	}
+	return k, err
+}
+
+// jwk is a single JSON web key as found in a JWKS file
+type jwk struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Use       string `json:"use"`
+	K         string `json:"k"`
+	N         string `json:"n"`
+	E         string `json:"e"`
+	Curve     string `json:"crv"`
+	X         string `json:"x"`
+	Y         string `json:"y"`
+}
+
+func parseJWKS(data []byte) ([]jwtKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+
+	var keys []jwtKey
+	for _, j := range set.Keys {
+		if len(j.Use) > 0 && j.Use != "sig" {
+			continue
+		}
+		k := jwtKey{id: j.KeyID, algorithm: j.Algorithm}
+		switch j.KeyType {
+		case "oct":
+			secret, err := base64.RawURLEncoding.DecodeString(j.K)
+			if err != nil {
+				return nil, fmt.Errorf("key %s: %v", j.KeyID, err)
+			}
+			k.key = secret
+			if len(k.algorithm) == 0 {
+				k.algorithm = "HS256"
+			}
+		case "RSA":
+			n, err := decodeBigInt(j.N)
+			if err != nil {
+				return nil, fmt.Errorf("key %s: %v", j.KeyID, err)
+			}
+			e, err := decodeBigInt(j.E)
+			if err != nil {
+				return nil, fmt.Errorf("key %s: %v", j.KeyID, err)
+			}
+			k.key = &rsa.PublicKey{N: n, E: int(e.Int64())}
+			if len(k.algorithm) == 0 {
+				k.algorithm = "RS256"
+			}
+		case "EC":
+			if j.Curve != "P-256" {
+				log.Debugf("jwks: skipping key %s with curve %s", j.KeyID, j.Curve)
+				continue
+			}
+			x, err := decodeBigInt(j.X)
+			if err != nil {
+				return nil, fmt.Errorf("key %s: %v", j.KeyID, err)
+			}
+			y, err := decodeBigInt(j.Y)
+			if err != nil {
+				return nil, fmt.Errorf("key %s: %v", j.KeyID, err)
+			}
+			k.key = &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+			if len(k.algorithm) == 0 {
+				k.algorithm = "ES256"
+			}
+		default:
+			log.Debugf("jwks: skipping key %s with type %s", j.KeyID, j.KeyType)
+			continue
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func claimString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []interface{}:
+		if len(v) > 0 {
+			return claimString(v[0])
+		}
+		return ""
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func getBearerToken(h http.Header) string {
+	auth := h.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJWTValidate(t *testing.T) {
+	v, err := NewJWTValidator(JWTSettings{
+		Keys:   []JWTKeySettings{{Algorithm: "HS256", Secret: "secret"}},
+		Claims: []string{"email"},
+	})
+	assert.NoError(t, err)
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"sub":   "example",
+		"email": "user@example.com",
+		"exp":   time.Now().Add(time.Minute).Unix(),
+	})
+	raw, _ := token.SignedString([]byte("secret"))
+
+	name, fields, err := v.Validate(raw)
+	assert.NoError(t, err)
+	assert.Equal(t, "example", name)
+	assert.EqualValues(t, DispatchRequest{"email": "user@example.com"}, fields)
+
+	bad, _ := token.SignedString([]byte("wrong"))
+	_, _, err = v.Validate(bad)
+	assert.Error(t, err)
+}
+
+func TestParseJWKS(t *testing.T) {
+	data := []byte(`{"keys": [
+		{"kty": "oct", "kid": "a", "k": "c2VjcmV0"},
+		{"kty": "RSA", "kid": "b", "use": "enc", "n": "AQAB", "e": "AQAB"},
+		{"kty": "EC", "kid": "c", "crv": "P-384", "x": "AQAB", "y": "AQAB"}
+	]}`)
+
+	keys, err := parseJWKS(data)
+	assert.NoError(t, err)
+	assert.Len(t, keys, 1)
+	assert.Equal(t, "HS256", keys[0].algorithm)
+	assert.Equal(t, []byte("secret"), keys[0].key)
+}
+
+func TestGetBearerToken(t *testing.T) {
+	headers := http.Header{}
+	assert.Equal(t, "", getBearerToken(headers))
+	headers.Set("Authorization", "Bearer abc.def.ghi")
+	assert.Equal(t, "abc.def.ghi", getBearerToken(headers))
+}
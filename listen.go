@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const unixPrefix = "unix:"
+
+// systemd passes activated sockets starting at this file descriptor
+const listenFdsStart = 3
+
+// isUnixAddress returns true if the address is in the form unix:/path/to.sock
+func isUnixAddress(address string) bool {
+	return strings.HasPrefix(address, unixPrefix)
+}
+
+// listen opens a listener on a tcp address or a unix socket address
+func listen(address string, socketMode os.FileMode) (net.Listener, error) {
+	if !isUnixAddress(address) {
+		return net.Listen("tcp", address)
+	}
+
+	socketPath := strings.TrimPrefix(address, unixPrefix)
+	if err := removeStaleSocket(socketPath); err != nil {
+		return nil, err
+	}
+
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+	if socketMode != 0 {
+		if err := os.Chmod(socketPath, socketMode); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// listenerAddress returns the address of a listener in the form accepted by
+// listen, so unix sockets keep their unix: prefix
+func listenerAddress(l net.Listener) string {
+	addr := l.Addr()
+	if addr.Network() == "unix" {
+		return unixPrefix + addr.String()
+	}
+	return addr.String()
+}
+
+// removeStaleSocket removes a socket left behind by an unclean exit. A socket
+// that still accepts connections belongs to a running server and is kept.
+func removeStaleSocket(socketPath string) error {
+	fi, err := os.Stat(socketPath)
+	if err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return nil
+	}
+	conn, err := net.DialTimeout("unix", socketPath, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("socket %s is in use by another server", socketPath)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return fmt.Errorf("socket %s: %v", socketPath, err)
+	}
+	log.Debugf("removing stale socket %s", socketPath)
+	if err := os.Remove(socketPath); err != nil {
+		return fmt.Errorf("could not remove stale socket: %v", err)
+	}
+	return nil
+}
+
+// systemdListeners returns the sockets passed in through systemd socket
+// activation, or nil if the process was not socket activated
+func systemdListeners() ([]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count == 0 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	// don't pass the sockets on to any child processes
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	var listeners []net.Listener
+	for i := 0; i < count; i++ {
+		name := fmt.Sprintf("LISTEN_FD_%d", listenFdsStart+i)
+		if i < len(names) && len(names[i]) > 0 {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(listenFdsStart+i), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("socket %s: %v", name, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// parseSocketMode parses an octal file mode such as "0660"
+func parseSocketMode(mode string) (os.FileMode, error) {
+	if len(mode) == 0 {
+		return 0, nil
+	}
+	m, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("socket mode '%s' is not a valid octal mode", mode)
+	}
+	return os.FileMode(m), nil
+}
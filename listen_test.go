@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListenUnix(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "dispatch.sock")
+	l, err := listen(unixPrefix+socketPath, 0600)
+	assert.NoError(t, err)
+
+	fi, err := os.Stat(socketPath)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+
+	l.Close()
+	_, err = os.Stat(socketPath)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestListenUnixStaleSocket(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "dispatch.sock")
+	running, err := listen(unixPrefix+socketPath, 0)
+	assert.NoError(t, err)
+
+	// a server is still answering on the socket
+	_, err = listen(unixPrefix+socketPath, 0)
+	assert.Error(t, err)
+
+	// the server went away without removing the socket
+	running.(*net.UnixListener).SetUnlinkOnClose(false)
+	running.Close()
+	l, err := listen(unixPrefix+socketPath, 0)
+	assert.NoError(t, err)
+	l.Close()
+}
+
+func TestListenerAddress(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "dispatch.sock")
+	l, err := listen(unixPrefix+socketPath, 0)
+	assert.NoError(t, err)
+	defer l.Close()
+	assert.Equal(t, unixPrefix+socketPath, listenerAddress(l))
+
+	// an https redirect can't be derived from a socket handed over by systemd
+	_, _, err = Server{}.newRedirectServer(listenerAddress(l), []net.Listener{l})
+	assert.EqualError(t, err, "an https redirect requires a tcp address")
+
+	tcp, err := listen("127.0.0.1:0", 0)
+	assert.NoError(t, err)
+	defer tcp.Close()
+	assert.Equal(t, tcp.Addr().String(), listenerAddress(tcp))
+}
+
+func TestParseSocketMode(t *testing.T) {
+	mode, err := parseSocketMode("0660")
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0660), mode)
+
+	_, err = parseSocketMode("rw-rw----")
+	assert.Error(t, err)
+}
+
+func TestSystemdListenersNotActivated(t *testing.T) {
+	os.Setenv("LISTEN_PID", "1")
+	os.Setenv("LISTEN_FDS", "1")
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+
+	listeners, err := systemdListeners()
+	assert.NoError(t, err)
+	assert.Nil(t, listeners)
+}
@@ -1,25 +1,43 @@
 package main
 
 import (
-	"crypto/tls"
+	"context"
+	"errors"
 	"fmt"
+	"mime"
 	"net/mail"
 	"os"
 	"strings"
 	"time"
+	"unicode"
 
 	gomail "gopkg.in/gomail.v2"
 
 	log "github.com/sirupsen/logrus"
 )
 
+// maxSubjectLength is the most characters kept from a subject
+const maxSubjectLength = 200
+
 // Message defines a message to send
 type Message struct {
-	FromAddress   string
-	ToAddressList []string
-	Subject       string
-	TextMessage   string
-	HTMLMessage   string
+	FromAddress    string
+	ToAddressList  []string
+	CcAddressList  []string
+	BccAddressList []string
+	ReplyTo        string
+	Subject        string
+	TextMessage    string
+	HTMLMessage    string
+	// MessageID is the same for every output and relay the message is sent to
+	MessageID string
+	// InReplyTo and References thread the message with earlier ones
+	InReplyTo  string
+	References []string
+	// Headers are extra headers added to emails
+	Headers map[string]string
+	// Fields are the request values the message was rendered from
+	Fields map[string]string
 }
 
 // SMTPSettings defines an SMTP server settings
@@ -28,10 +46,94 @@ type SMTPSettings struct {
 	Port     int
 	UserName string
 	Password string
+	// Auth is the authentication mechanism, picked automatically when empty
+	Auth   string
+	OAuth2 OAuth2Settings
+	// Relays replace the single server above when set
+	Relays []SMTPRelaySettings
+	// MaxFailures in a row mark a relay as down
+	MaxFailures int
+	// ProbeInterval is how often a relay that is down is tried again
+	ProbeInterval time.Duration
+	// PoolSize is the most connections kept open to each relay
+	PoolSize int
+	// IdleTimeout closes connections that have not been used for a while
+	IdleTimeout time.Duration
+	// MaxMessages is how many messages are sent over a connection before
+	// it is replaced
+	MaxMessages int
+	// Inbox captures messages instead of sending them when set
+	Inbox *Inbox
+	// MessageIDDomain is the domain of the generated Message-IDs, the host
+	// name is used when empty
+	MessageIDDomain string
+}
+
+// SMTPTransport sends messages through an SMTP server
+type SMTPTransport struct {
+	name   string
+	relays *Relays
+	names  []string
+}
+
+type smtpOutputSettings struct {
+	Relays []string `yaml:"relays"`
+}
+
+func newSMTPTransport(d *Dispatch, target DispatchTarget, config OutputConfig) (Transport, error) {
+	if !target.hasRecipients() {
+		return nil, errors.New("target does not have a destination")
+	}
+	var s smtpOutputSettings
+	if err := config.decode(&s); err != nil {
+		return nil, err
+	}
+	for _, name := range s.Relays {
+		if !d.relays.Has(name) {
+			return nil, fmt.Errorf("relay '%s' does not exist", name)
+		}
+	}
+	return &SMTPTransport{config.Name, d.relays, s.Relays}, nil
+}
+
+// Name returns the output name
+func (t *SMTPTransport) Name() string {
+	return t.name
+}
+
+// Send delivers the message to the SMTP server
+func (t *SMTPTransport) Send(ctx context.Context, message Message) error {
+	return sendMessage(ctx, message, t.relays, t.names)
+}
+
+// Check connects to the SMTP relays and disconnects
+func (t *SMTPTransport) Check(ctx context.Context) error {
+	if t.relays.inbox != nil {
+		return nil
+	}
+	return t.relays.Check(ctx, t.names)
+}
+
+// sendMessage sends the message through the first healthy relay of names,
+// or captures it when running with an inbox
+func sendMessage(ctx context.Context, message Message, relays *Relays, names []string) error {
+	msg, err := buildMessage(message)
+	if err != nil {
+		return err
+	}
+
+	if relays.inbox != nil {
+		return relays.inbox.Capture(message, msg)
+	}
+	if err := relays.Send(ctx, msg, names); err != nil {
+		log.Error("An error occurred when sending email")
+		log.Error(err)
+		return err
+	}
+	return nil
 }
 
-func sendMessage(message Message, smtp SMTPSettings) (success bool) {
-	success = false
+func buildMessage(message Message) (*gomail.Message, error) {
 	msg := gomail.NewMessage()
 	log.Debugf("Date: %s", time.Now().Format(time.RFC1123Z))
 
@@ -45,14 +147,57 @@ func sendMessage(message Message, smtp SMTPSettings) (success bool) {
 	if err != nil {
 		log.Warnf("%v", err)
 		log.Error("Will not send email")
-		return false
+		return nil, err
 	} else if len(toAddresses) > 0 {
 		log.Debugf("To: %s", strings.Join(toAddresses, ", "))
 		msg.SetHeader("To", toAddresses...)
 	}
 
-	log.Debugf("Subject: %s", message.Subject)
-	msg.SetHeader("Subject", message.Subject)
+	ccAddresses, err := formatEmailList(message.CcAddressList)
+	if err != nil {
+		log.Warnf("%v", err)
+		return nil, err
+	} else if len(ccAddresses) > 0 {
+		log.Debugf("Cc: %s", strings.Join(ccAddresses, ", "))
+		msg.SetHeader("Cc", ccAddresses...)
+	}
+
+	bccAddresses, err := formatEmailList(message.BccAddressList)
+	if err != nil {
+		log.Warnf("%v", err)
+		return nil, err
+	} else if len(bccAddresses) > 0 {
+		log.Debugf("Bcc: %s", strings.Join(bccAddresses, ", "))
+		msg.SetHeader("Bcc", bccAddresses...)
+	}
+
+	if len(message.ReplyTo) > 0 {
+		replyTo, err := mail.ParseAddress(message.ReplyTo)
+		if err != nil {
+			log.Warnf("Could not parse reply-to '%s': %v", message.ReplyTo, err)
+		} else {
+			log.Debugf("Reply-To: %s", replyTo)
+			msg.SetAddressHeader("Reply-To", replyTo.Address, replyTo.Name)
+		}
+	}
+
+	subject := sanitizeSubject(message.Subject)
+	log.Debugf("Subject: %s", subject)
+	// non-ascii subjects are sent as RFC 2047 encoded-words
+	msg.SetHeader("Subject", mime.QEncoding.Encode("UTF-8", subject))
+
+	if len(message.MessageID) > 0 {
+		msg.SetHeader("Message-ID", message.MessageID)
+	}
+	if len(message.InReplyTo) > 0 {
+		msg.SetHeader("In-Reply-To", message.InReplyTo)
+	}
+	if len(message.References) > 0 {
+		msg.SetHeader("References", strings.Join(message.References, " "))
+	}
+	for name, value := range message.Headers {
+		msg.SetHeader(name, mime.QEncoding.Encode("UTF-8", sanitizeHeader(value)))
+	}
 
 	haveText := len(message.TextMessage) > 0
 	haveHTML := len(message.HTMLMessage) > 0
@@ -73,27 +218,32 @@ func sendMessage(message Message, smtp SMTPSettings) (success bool) {
 		msg.SetBody("text/html", message.HTMLMessage)
 	} else {
 		log.Warn("There is no message to send")
-		return
+		return nil, errors.New("there is no message to send")
 	}
+	return msg, nil
+}
 
-	//TODO: Add an option for tls/ssl connections
-	var dialer *gomail.Dialer
-	if len(smtp.UserName) > 0 || len(smtp.Password) > 0 {
-		log.Debugf("Connecting too %s:*****@%s:%d", smtp.UserName, smtp.Host, smtp.Port)
-		dialer = gomail.NewDialer(smtp.Host, smtp.Port, smtp.UserName, smtp.Password)
-	} else {
-		log.Debugf("Connecting too %s:%d", smtp.Host, smtp.Port)
-		dialer = &gomail.Dialer{Host: smtp.Host, Port: smtp.Port}
-	}
-	dialer.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+// sanitizeHeader makes a value safe to use as a header. Line breaks and
+// other control characters are replaced with spaces so the value can never
+// start another header.
+func sanitizeHeader(value string) string {
+	value = strings.ToValidUTF8(value, "")
+	value = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, value)
+	return strings.Join(strings.Fields(value), " ")
+}
 
-	if err := dialer.DialAndSend(msg); err != nil {
-		log.Error("An error occurred when sending email")
-		log.Error(err)
-		return false
+// sanitizeSubject sanitizes a subject header and cuts long subjects short
+func sanitizeSubject(subject string) string {
+	subject = sanitizeHeader(subject)
+	if runes := []rune(subject); len(runes) > maxSubjectLength {
+		subject = strings.TrimSpace(string(runes[:maxSubjectLength]))
 	}
-	success = true
-	return success
+	return subject
 }
 
 func formatEmailList(list []string) ([]string, error) {
@@ -125,6 +275,19 @@ func FormatEmail(address string) (string, error) {
 	return fAddress, nil
 }
 
+// getReplyTo returns the submitter as a reply-to address, using the name
+// field as the display name
+func getReplyTo(email string, name string) string {
+	address, err := mail.ParseAddress(email)
+	if err != nil {
+		return ""
+	}
+	if name = strings.TrimSpace(name); len(name) > 0 {
+		address.Name = name
+	}
+	return address.String()
+}
+
 func getDefaultEmailAddress() string {
 	hostname, err := os.Hostname()
 	if err != nil {
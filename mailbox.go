@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var maildirCounter uint64
+
+var (
+	// mboxLockTimeout is how long to wait for another program to release
+	// the lock of an mbox file
+	mboxLockTimeout = 10 * time.Second
+	// mboxStaleLock is the age after which a lock is considered abandoned
+	mboxStaleLock = 5 * time.Minute
+)
+
+// mboxLocks serializes appends to the same mbox file from different targets
+var mboxLocks sync.Map
+
+// MaildirTransport stores each message as a file in a maildir
+type MaildirTransport struct {
+	name     string
+	settings mailboxSettings
+}
+
+// MboxTransport appends messages to an mbox file
+type MboxTransport struct {
+	name     string
+	settings mailboxSettings
+}
+
+type mailboxSettings struct {
+	Path string `yaml:"path"`
+}
+
+func newMaildirTransport(d *Dispatch, target DispatchTarget, config OutputConfig) (Transport, error) {
+	t := &MaildirTransport{name: config.Name}
+	if err := config.decode(&t.settings); err != nil {
+		return nil, err
+	}
+	if len(t.settings.Path) == 0 {
+		return nil, errors.New("a path is required")
+	}
+	return t, nil
+}
+
+// Name returns the output name
+func (t *MaildirTransport) Name() string {
+	return t.name
+}
+
+// Send writes the message to tmp and moves it into new once it is complete
+func (t *MaildirTransport) Send(ctx context.Context, message Message) error {
+	data, err := formatMailboxMessage(message)
+	if err != nil {
+		return err
+	}
+	if err := t.create(); err != nil {
+		return err
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	hostname = strings.NewReplacer("/", "\\057", ":", "\\072").Replace(hostname)
+	now := time.Now()
+	name := fmt.Sprintf("%d.M%dP%dQ%d.%s", now.Unix(), now.Nanosecond()/1000, os.Getpid(),
+		atomic.AddUint64(&maildirCounter, 1), hostname)
+
+	tmpPath := filepath.Join(t.settings.Path, "tmp", name)
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, filepath.Join(t.settings.Path, "new", name)); err != nil {
+		return err
+	}
+	// the rename is only on disk once the directory is synced
+	return syncDir(filepath.Join(t.settings.Path, "new"))
+}
+
+// syncDir flushes the entries of a directory to disk
+func syncDir(path string) error {
+	// windows can not sync directories, renames there are written through
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	err = dir.Sync()
+	if closeErr := dir.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Check makes sure the maildir exists or can be created
+func (t *MaildirTransport) Check(ctx context.Context) error {
+	return t.create()
+}
+
+func (t *MaildirTransport) create() error {
+	for _, dir := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(t.settings.Path, dir), 0700); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newMboxTransport(d *Dispatch, target DispatchTarget, config OutputConfig) (Transport, error) {
+	t := &MboxTransport{name: config.Name}
+	if err := config.decode(&t.settings); err != nil {
+		return nil, err
+	}
+	if len(t.settings.Path) == 0 {
+		return nil, errors.New("a path is required")
+	}
+	t.settings.Path = filepath.Clean(t.settings.Path)
+	return t, nil
+}
+
+// Name returns the output name
+func (t *MboxTransport) Name() string {
+	return t.name
+}
+
+// Send appends the message to the mbox file
+func (t *MboxTransport) Send(ctx context.Context, message Message) error {
+	data, err := formatMailboxMessage(message)
+	if err != nil {
+		return err
+	}
+	sender := message.FromAddress
+	if address, err := mail.ParseAddress(sender); err == nil {
+		sender = address.Address
+	}
+	if len(sender) == 0 {
+		sender = "MAILER-DAEMON"
+	}
+
+	var entry bytes.Buffer
+	fmt.Fprintf(&entry, "From %s %s\n", sender, time.Now().UTC().Format(time.ANSIC))
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		// mboxrd quoting, so the lines can be unquoted again when reading
+		if strings.HasPrefix(strings.TrimLeft(line, ">"), "From ") {
+			line = ">" + line
+		}
+		entry.WriteString(line + "\n")
+	}
+	entry.WriteString("\n")
+
+	lock, _ := mboxLocks.LoadOrStore(t.settings.Path, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+
+	unlock, err := lockMbox(ctx, t.settings.Path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	file, err := os.OpenFile(t.settings.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(entry.Bytes()); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// lockMbox takes the dotlock of the mbox file, so other mail programs don't
+// write to it at the same time, and returns the function to release it
+func lockMbox(ctx context.Context, path string) (func(), error) {
+	lockPath := path + ".lock"
+	deadline := time.Now().Add(mboxLockTimeout)
+	for {
+		file, err := os.OpenFile(lockPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			fmt.Fprintf(file, "%d\n", os.Getpid())
+			file.Close()
+			return func() { os.Remove(lockPath) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		// a lock left behind by a program that crashed would block the
+		// mailbox forever
+		if info, err := os.Stat(lockPath); err == nil && time.Since(info.ModTime()) > mboxStaleLock {
+			log.Warnf("removing stale lock %s", lockPath)
+			if err := os.Remove(lockPath); err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("mbox %s is locked", path)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// Check makes sure the mbox file can be written to, or that its directory
+// exists when the file has not been created yet
+func (t *MboxTransport) Check(ctx context.Context) error {
+	file, err := os.OpenFile(t.settings.Path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err == nil {
+		return file.Close()
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+	dir := filepath.Dir(t.settings.Path)
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	return nil
+}
+
+// formatMailboxMessage builds the message with unix line endings, which is
+// how messages are kept in mailboxes on disk
+func formatMailboxMessage(message Message) ([]byte, error) {
+	msg, err := buildMessage(message)
+	if err != nil {
+		return nil, err
+	}
+	var data bytes.Buffer
+	if _, err := msg.WriteTo(&data); err != nil {
+		return nil, err
+	}
+	return bytes.ReplaceAll(data.Bytes(), []byte("\r\n"), []byte("\n")), nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMaildirTransport(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "Maildir")
+	transport, err := newMaildirTransport(nil, DispatchTarget{},
+		OutputConfig{Name: "archive", Type: "maildir", Options: map[string]interface{}{"path": dir}})
+	assert.NoError(t, err)
+
+	message := Message{FromAddress: "dispatch@my-site.com", Subject: "example", TextMessage: "Hello"}
+	assert.NoError(t, transport.Send(context.Background(), message))
+	assert.NoError(t, transport.Send(context.Background(), message))
+
+	files, _ := ioutil.ReadDir(filepath.Join(dir, "new"))
+	assert.Len(t, files, 2)
+	files, _ = ioutil.ReadDir(filepath.Join(dir, "tmp"))
+	assert.Len(t, files, 0)
+	assert.DirExists(t, filepath.Join(dir, "cur"))
+}
+
+func TestMboxTransport(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "archive.mbox")
+	transport, err := newMboxTransport(nil, DispatchTarget{},
+		OutputConfig{Name: "archive", Type: "mbox", Options: map[string]interface{}{"path": path}})
+	assert.NoError(t, err)
+
+	// checking does not create the file
+	assert.NoError(t, transport.Check(context.Background()))
+	assert.NoFileExists(t, path)
+
+	message := Message{
+		FromAddress: "Dispatch <dispatch@my-site.com>",
+		Subject:     "example",
+		TextMessage: "Hello\nFrom the contact form",
+	}
+	assert.NoError(t, transport.Send(context.Background(), message))
+	assert.NoError(t, transport.Send(context.Background(), message))
+
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	mbox := string(data)
+	assert.True(t, strings.HasPrefix(mbox, "From dispatch@my-site.com "))
+	assert.Equal(t, 1, strings.Count(mbox, "\n\nFrom dispatch@my-site.com "))
+	assert.Contains(t, mbox, "\n>From the contact form\n")
+	assert.NotContains(t, mbox, "\r\n")
+	assert.NoError(t, transport.Check(context.Background()))
+
+	missing, err := newMboxTransport(nil, DispatchTarget{},
+		OutputConfig{Name: "archive", Type: "mbox", Options: map[string]interface{}{"path": filepath.Join(path+".d", "archive.mbox")}})
+	assert.NoError(t, err)
+	assert.Error(t, missing.Check(context.Background()))
+}
+
+func TestMboxTransportLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "archive.mbox")
+	transport, err := newMboxTransport(nil, DispatchTarget{},
+		OutputConfig{Name: "archive", Type: "mbox", Options: map[string]interface{}{"path": path}})
+	assert.NoError(t, err)
+	message := Message{FromAddress: "dispatch@my-site.com", Subject: "example", TextMessage: "Hello"}
+
+	// a lock held by another program makes the send wait for it
+	assert.NoError(t, ioutil.WriteFile(path+".lock", nil, 0600))
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, transport.Send(ctx, message))
+	assert.NoFileExists(t, path)
+
+	// an abandoned lock is removed
+	old := time.Now().Add(-time.Hour)
+	assert.NoError(t, os.Chtimes(path+".lock", old, old))
+	assert.NoError(t, transport.Send(context.Background(), message))
+	assert.FileExists(t, path)
+	assert.NoFileExists(t, path+".lock")
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"math"
@@ -67,11 +68,25 @@ func init() {
 		"Path to target configs (default \"/etc/dispatch/targets-enabled\")")
 	RootCmd.PersistentFlags().BoolVar(&check, "check", false,
 		"Check the config for errors and exit")
+	RootCmd.PersistentFlags().Bool("dev", false,
+		"Capture messages instead of sending them and serve them on /dev/inbox")
 
 	RootCmd.PersistentFlags().StringP("address", "a", "0.0.0.0",
-		"The IP address to bind the web server too")
+		"The IP address or unix:/path/to.sock socket to bind the web server too")
 	RootCmd.PersistentFlags().IntP("port", "p", 2525,
 		"The port to bind the webserver too")
+	RootCmd.PersistentFlags().String("socket-mode", "0660",
+		"The permissions to set on a unix socket")
+	RootCmd.PersistentFlags().String("tls-cert", "",
+		"Path to a TLS certificate to serve HTTPS with")
+	RootCmd.PersistentFlags().String("tls-key", "",
+		"Path to the TLS certificate key")
+	RootCmd.PersistentFlags().String("tls-client-ca", "",
+		"Require client certificates signed by this CA")
+	RootCmd.PersistentFlags().Int("redirect-port", 0,
+		"Redirect plain HTTP on this port to HTTPS (disabled by default)")
+	RootCmd.PersistentFlags().Duration("shutdown-timeout", 30*time.Second,
+		"How long to wait for in-flight requests to finish when shutting down")
 	RootCmd.PersistentFlags().StringP("rate-limit", "r", "inf",
 		"The rate limit at which to send emails in the format 'inf|<num>/<duration>'. "+
 			"inf for infinite or 1/10s for 1 email per 10 seconds.")
@@ -84,6 +99,8 @@ func init() {
 		"Authenticate the SMTP server with this user")
 	RootCmd.PersistentFlags().StringP("smtp-password", "w", "",
 		"Authenticate the SMTP server with this password")
+	RootCmd.PersistentFlags().String("smtp-auth", "",
+		"The SMTP auth mechanism none|plain|login|cram-md5|xoauth2 (default picks one)")
 
 	RootCmd.PersistentFlags().String("target-name", "",
 		"Target name for an optional target")
@@ -105,13 +122,22 @@ func init() {
 	viper.BindEnv("config")
 	viper.BindEnv("log_file")
 	viper.BindEnv("target_dir")
+	viper.BindEnv("dev")
 	viper.BindEnv("address")
 	viper.BindEnv("port")
+	viper.BindEnv("socket_mode")
+	viper.BindEnv("tls_cert")
+	viper.BindEnv("tls_key")
+	viper.BindEnv("tls_client_ca")
+	viper.BindEnv("redirect_port")
+	viper.BindEnv("shutdown_timeout")
 	viper.BindEnv("rate_limit")
 	viper.BindEnv("smtp_server")
 	viper.BindEnv("smtp_port")
 	viper.BindEnv("smtp_username")
 	viper.BindEnv("smtp_password")
+	viper.BindEnv("smtp_auth")
+	viper.BindEnv("smtp_mode")
 	viper.BindEnv("target_name")
 	viper.BindEnv("target_auth_token")
 	viper.BindEnv("target_from_address")
@@ -120,21 +146,40 @@ func init() {
 	viper.BindPFlag("config", RootCmd.PersistentFlags().Lookup("config"))
 	viper.BindPFlag("log_file", RootCmd.PersistentFlags().Lookup("log-file"))
 	viper.BindPFlag("target_dir", RootCmd.PersistentFlags().Lookup("target-dir"))
+	viper.BindPFlag("dev", RootCmd.PersistentFlags().Lookup("dev"))
 	viper.BindPFlag("web.address", RootCmd.PersistentFlags().Lookup("address"))
 	viper.BindPFlag("web.port", RootCmd.PersistentFlags().Lookup("port"))
+	viper.BindPFlag("web.socket_mode", RootCmd.PersistentFlags().Lookup("socket-mode"))
+	viper.BindPFlag("web.tls_cert", RootCmd.PersistentFlags().Lookup("tls-cert"))
+	viper.BindPFlag("web.tls_key", RootCmd.PersistentFlags().Lookup("tls-key"))
+	viper.BindPFlag("web.tls_client_ca", RootCmd.PersistentFlags().Lookup("tls-client-ca"))
+	viper.BindPFlag("web.redirect_port", RootCmd.PersistentFlags().Lookup("redirect-port"))
+	viper.BindPFlag("web.shutdown_timeout", RootCmd.PersistentFlags().Lookup("shutdown-timeout"))
 	viper.BindPFlag("rate_limit", RootCmd.PersistentFlags().Lookup("rate-limit"))
 	viper.BindPFlag("smtp.server", RootCmd.PersistentFlags().Lookup("smtp-server"))
 	viper.BindPFlag("smtp.port", RootCmd.PersistentFlags().Lookup("smtp-port"))
 	viper.BindPFlag("smtp.username", RootCmd.PersistentFlags().Lookup("smtp-username"))
 	viper.BindPFlag("smtp.password", RootCmd.PersistentFlags().Lookup("smtp-password"))
+	viper.BindPFlag("smtp.auth", RootCmd.PersistentFlags().Lookup("smtp-auth"))
 
 	viper.SetDefault("log_file", "/var/log/dispatch.log")
 	viper.SetDefault("target_dir", "/etc/dispatch/targets-enabled")
 	viper.SetDefault("web.address", "0.0.0.0")
 	viper.SetDefault("web.port", 2525)
+	viper.SetDefault("web.socket_mode", "0660")
+	viper.SetDefault("web.shutdown_timeout", "30s")
 	viper.SetDefault("rate_limit", "inf")
 	viper.SetDefault("smtp.server", "localhost")
 	viper.SetDefault("smtp.port", 25)
+	viper.SetDefault("smtp.mode", "send")
+	viper.SetDefault("smtp.max_failures", 3)
+	viper.SetDefault("smtp.probe_interval", "30s")
+	viper.SetDefault("smtp.pool_size", 4)
+	viper.SetDefault("smtp.idle_timeout", "30s")
+	viper.SetDefault("smtp.max_messages", 100)
+	viper.SetDefault("time.zone", "UTC")
+	viper.SetDefault("time.format", defaultTimeFormat)
+	viper.SetDefault("time.locale", "en")
 
 	dotReplacer := strings.NewReplacer(".", "_")
 	viper.SetEnvKeyReplacer(dotReplacer)
@@ -198,17 +243,18 @@ func run(cmd *cobra.Command, args []string) {
 	}
 	log.Debugf("build: info=%s %s/%s", runtime.Version(), runtime.GOOS, runtime.GOARCH)
 
+	var logFile *os.File
 	logFilePath := viper.GetString("log_file")
 	log.Debugf("config: log_file=%s", logFilePath)
 	if strings.ToLower(logFilePath) == "stdout" || logFilePath == "-" || logFilePath == "" {
 		log.SetOutput(os.Stdout)
 	} else {
+		var err error
 		logFilePath = getLogFilePath(logFilePath)
-		logFile, err := os.OpenFile(logFilePath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+		logFile, err = os.OpenFile(logFilePath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
 		if err != nil {
 			log.Fatalf("error opening log file=%v", err)
 		}
-		defer logFile.Close()
 		log.SetOutput(logFile)
 	}
 
@@ -218,19 +264,93 @@ func run(cmd *cobra.Command, args []string) {
 	}
 
 	smtpSettings := SMTPSettings{
-		viper.GetString("smtp.server"),
-		viper.GetInt("smtp.port"),
-		viper.GetString("smtp.username"),
-		viper.GetString("smtp.password"),
+		Host:     viper.GetString("smtp.server"),
+		Port:     viper.GetInt("smtp.port"),
+		UserName: viper.GetString("smtp.username"),
+		Password: viper.GetString("smtp.password"),
 	}
-	log.Debugf("config: smtp={Host:%s Port:%d UserName:%s}", smtpSettings.Host,
-		smtpSettings.Port, smtpSettings.UserName)
+	if err := viper.UnmarshalKey("smtp.relays", &smtpSettings.Relays); err != nil {
+		log.Fatalf("error parsing smtp relays: %v", err)
+	}
+	smtpSettings.Auth = strings.ToLower(viper.GetString("smtp.auth"))
+	if err := viper.UnmarshalKey("smtp.oauth2", &smtpSettings.OAuth2); err != nil {
+		log.Fatalf("error parsing smtp oauth2 config: %v", err)
+	}
+	err := resolveSecrets(&smtpSettings.Password, &smtpSettings.OAuth2.ClientSecret,
+		&smtpSettings.OAuth2.RefreshToken)
+	if err != nil {
+		log.Fatalf("error: smtp: %v", err)
+	}
+	if err := prepareRelays(smtpSettings.Relays); err != nil {
+		log.Fatalf("error: smtp relays: %v", err)
+	}
+	if err := checkSMTPAuth(defaultRelay(smtpSettings)); len(smtpSettings.Relays) == 0 && err != nil {
+		log.Fatalf("error: smtp: %v", err)
+	}
+	smtpSettings.MaxFailures = viper.GetInt("smtp.max_failures")
+	smtpSettings.ProbeInterval = viper.GetDuration("smtp.probe_interval")
+	smtpSettings.PoolSize = viper.GetInt("smtp.pool_size")
+	smtpSettings.IdleTimeout = viper.GetDuration("smtp.idle_timeout")
+	smtpSettings.MaxMessages = viper.GetInt("smtp.max_messages")
+	smtpSettings.MessageIDDomain = viper.GetString("smtp.message_id_domain")
+	log.Debugf("config: smtp-pool={Size:%d IdleTimeout:%s MaxMessages:%d}", smtpSettings.PoolSize,
+		smtpSettings.IdleTimeout, smtpSettings.MaxMessages)
+	for _, relay := range smtpSettings.Relays {
+		log.Debugf("config: smtp-relay={Name:%s Host:%s Port:%d UserName:%s Auth:%s Priority:%d Weight:%d}",
+			relay.Name, relay.Host, relay.Port, relay.UserName, relay.Auth, relay.Priority, relay.Weight)
+	}
+	smtpMode := strings.ToLower(viper.GetString("smtp.mode"))
+	if viper.GetBool("dev") {
+		smtpMode = "capture"
+	}
+	switch smtpMode {
+	case "send":
+	case "capture":
+		smtpSettings.Inbox = NewInbox(inboxSize)
+	default:
+		log.Fatalf("error: smtp mode '%s' must be send or capture", smtpMode)
+	}
+	log.Debugf("config: smtp={Host:%s Port:%d UserName:%s Auth:%s Mode:%s}", smtpSettings.Host,
+		smtpSettings.Port, smtpSettings.UserName, smtpSettings.Auth, smtpMode)
 
 	targetsDir := viper.Get("target_dir").(string)
 	log.Debugf("config: targets=%s", targetsDir)
 	dispatch = NewDispatch(targetsDir, smtpSettings)
 
-	targetAuth := viper.GetString("target_auth_token")
+	var timeSettings TimeSettings
+	if err := viper.UnmarshalKey("time", &timeSettings); err != nil {
+		log.Fatalf("error parsing time config: %v", err)
+	}
+	if err := timeSettings.prepare(); err != nil {
+		log.Fatalf("error: time: %v", err)
+	}
+	dispatch.SetTimeSettings(timeSettings)
+	log.Debugf("config: time={Zone:%s Format:%s Locale:%s}", timeSettings.Zone,
+		timeSettings.Format, timeSettings.Locale)
+
+	if viper.IsSet("jwt") {
+		var jwtSettings JWTSettings
+		if err := viper.UnmarshalKey("jwt", &jwtSettings); err != nil {
+			log.Fatalf("error parsing jwt config: %v", err)
+		}
+		for i := range jwtSettings.Keys {
+			if err := resolveSecrets(&jwtSettings.Keys[i].Secret); err != nil {
+				log.Fatalf("error loading jwt config: %v", err)
+			}
+		}
+		jwtValidator, err := NewJWTValidator(jwtSettings)
+		if err != nil {
+			log.Fatalf("error loading jwt config: %v", err)
+		}
+		log.Debugf("config: jwt={Keys:%d TargetClaim:%s Claims:%v}", len(jwtValidator.keys),
+			jwtValidator.targetClaim, jwtValidator.claims)
+		dispatch.SetJWTValidator(jwtValidator)
+	}
+
+	targetAuth, err := resolveSecret(viper.GetString("target_auth_token"))
+	if err != nil {
+		log.Fatalf("error: optional target: %v", err)
+	}
 	targetName := viper.GetString("target_name")
 	targetFrom := viper.GetString("target_from_address")
 	targetTo := viper.GetStringSlice("target_to_address")
@@ -243,13 +363,30 @@ func run(cmd *cobra.Command, args []string) {
 			singleTarget.From = targetFrom
 		}
 		log.Debugf("adding optional target: %v", singleTarget)
-		dispatch.AddTarget(singleTarget)
+		if err := dispatch.AddTarget(singleTarget); err != nil {
+			log.Errorf("error: optional target %s: %v", singleTarget.Name, err)
+		}
 	} else {
 		log.Debugf("not enough info to add optional target")
 	}
 
 	address := viper.GetString("web.address")
 	port := viper.GetInt("web.port")
+	listenAddress := address
+	if !isUnixAddress(address) {
+		listenAddress = fmt.Sprintf("%s:%d", address, port)
+	}
+	socketMode, err := parseSocketMode(viper.GetString("web.socket_mode"))
+	if err != nil {
+		log.Fatalf("error parsing socket mode: %v", err)
+	}
+
+	tlsSettings := TLSSettings{
+		viper.GetString("web.tls_cert"),
+		viper.GetString("web.tls_key"),
+		viper.GetString("web.tls_client_ca"),
+		viper.GetInt("web.redirect_port"),
+	}
 
 	limitMax, limitTTL, err := getRateLimit(viper.GetString("rate_limit"))
 	if err != nil {
@@ -257,8 +394,30 @@ func run(cmd *cobra.Command, args []string) {
 	}
 
 	if check {
-		log.Debugf("config: webserver=%s:%d", address, port)
+		log.Debugf("config: webserver=%s", listenAddress)
+		if isUnixAddress(address) {
+			log.Debugf("config: socket-mode=%s", socketMode)
+		}
+		if tlsSettings.Enabled() {
+			if _, _, err := newTLSConfig(tlsSettings); err != nil {
+				log.Fatalf("error loading tls config: %v", err)
+			}
+			log.Debugf("config: tls=%+v", tlsSettings)
+		}
 		log.Debugf("config: rate-limit=%1.1f/%s", limitMax, limitTTL)
+		log.Debugf("config: shutdown-timeout=%s", viper.GetDuration("web.shutdown_timeout"))
+		if failed := dispatch.LoadErrors(); failed > 0 {
+			log.Fatalf("%d targets could not be loaded", failed)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		for output, err := range dispatch.CheckOutputs(ctx) {
+			if err != nil {
+				log.Warnf("output %s is not reachable: %v", output, err)
+			} else {
+				log.Debugf("output %s is reachable", output)
+			}
+		}
+		cancel()
 		log.Infof("Config file format checks out, exiting")
 		if !debug {
 			log.Infof("Use the --debug flag for more info")
@@ -268,7 +427,31 @@ func run(cmd *cobra.Command, args []string) {
 
 	// finally, run the webserver
 	server := NewServer(dispatch, limitMax, limitTTL)
-	server.Run(fmt.Sprintf("%s:%d", address, port))
+	server.SetShutdownTimeout(viper.GetDuration("web.shutdown_timeout"))
+	server.SetSocketMode(socketMode)
+	if smtpSettings.Inbox != nil {
+		server.EnableInbox(smtpSettings.Inbox)
+	}
+	if tlsSettings.Enabled() {
+		if err := server.EnableTLS(tlsSettings); err != nil {
+			log.Fatalf("error loading tls config: %v", err)
+		}
+	}
+	err = server.Run(listenAddress)
+	exitCode := 0
+	if err == ErrShutdownTimeout {
+		log.Errorf("shutdown: %v, some messages may not have been sent", err)
+		exitCode = 2
+	} else if err != nil {
+		log.Errorf("webserver: %v", err)
+		exitCode = 1
+	}
+
+	if logFile != nil {
+		logFile.Sync()
+		logFile.Close()
+	}
+	os.Exit(exitCode)
 }
 
 func getRateLimit(rateLimit string) (limitMax float64, limitTTL time.Duration, err error) {
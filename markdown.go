@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	htmltemplate "html/template"
+
+	"github.com/Masterminds/sprig/v3"
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/renderer/html"
+)
+
+// defaultHTMLTemplate is used by targets that render markdown without their
+// own html template
+const defaultHTMLTemplate = `<table>
+<tr><th align="left">Timestamp:</th><td>{{ index . "timestamp" }}</td></tr>
+{{- range $key, $value := . }}
+{{- if eq $key "message" "auth-token" "timestamp" "timestamp_iso" }}{{ else }}
+<tr><th align="left">{{ title $key }}:</th><td>{{ $value }}</td></tr>
+{{- end }}{{ end }}
+</table>
+<hr>
+{{ index . "message" | markdown }}
+`
+
+// markdownRenderer follows CommonMark, raw html in the source is left out and
+// line breaks are kept since people rarely write markdown on purpose
+var markdownRenderer = goldmark.New(goldmark.WithRendererOptions(html.WithHardWraps()))
+
+// markdownPolicy only allows the formatting markdown produces, anything else
+// is dropped from the rendered html
+var markdownPolicy = newMarkdownPolicy()
+
+func newMarkdownPolicy() *bluemonday.Policy {
+	p := bluemonday.NewPolicy()
+	p.AllowElements("p", "br", "hr", "h1", "h2", "h3", "h4", "h5", "h6",
+		"strong", "em", "del", "code", "pre", "blockquote", "ul", "ol", "li")
+	p.AllowAttrs("start").Matching(bluemonday.Integer).OnElements("ol")
+	p.AllowAttrs("href").OnElements("a")
+	p.AllowURLSchemes("http", "https", "mailto")
+	p.RequireParseableURLs(true)
+	p.RequireNoFollowOnLinks(true)
+	return p
+}
+
+// renderMarkdown converts markdown to sanitized html
+func renderMarkdown(source string) (htmltemplate.HTML, error) {
+	var out bytes.Buffer
+	if err := markdownRenderer.Convert([]byte(source), &out); err != nil {
+		return "", err
+	}
+	return htmltemplate.HTML(markdownPolicy.SanitizeReader(&out).String()), nil
+}
+
+// markdownFunc is the markdown template function, falling back to the
+// escaped source if it can not be rendered
+func markdownFunc(source string) htmltemplate.HTML {
+	rendered, err := renderMarkdown(source)
+	if err != nil {
+		return htmltemplate.HTML(htmltemplate.HTMLEscapeString(source))
+	}
+	return rendered
+}
+
+// htmlFuncMap returns the functions available to html templates
+func htmlFuncMap() htmltemplate.FuncMap {
+	funcs := sprig.FuncMap()
+	funcs["markdown"] = markdownFunc
+	return funcs
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderMarkdown(t *testing.T) {
+	html, err := renderMarkdown("**hi** there\nsecond line\n\n- [site](https://my-site.com)\n- [bad](javascript:alert(1))")
+	assert.NoError(t, err)
+	assert.Contains(t, string(html), "<p><strong>hi</strong> there<br>")
+	assert.Contains(t, string(html), `<a href="https://my-site.com" rel="nofollow">site</a>`)
+	assert.NotContains(t, string(html), "javascript")
+
+	html, err = renderMarkdown("<script>alert(1)</script>\n\n<img src=x onerror=alert(1)>\n\n![pixel](https://tracker.com/p.gif)")
+	assert.NoError(t, err)
+	assert.NotContains(t, string(html), "<script")
+	assert.NotContains(t, string(html), "<img")
+}
+
+func TestTargetMarkdown(t *testing.T) {
+	target, err := loadTarget("example.yml", []byte(`
+name: example
+to: [admin@my-site.com]
+markdown: true
+`))
+	assert.NoError(t, err)
+
+	transport := &testTransport{name: "test"}
+	target.transports = []Transport{transport}
+	d := NewDispatch(t.TempDir(), SMTPSettings{})
+	request := DispatchRequest{"name": "<Jo>", "message": "# Hello\n*there*"}
+	_, err = d.SendTarget(target, request)
+	assert.NoError(t, err)
+	message := transport.messages[0]
+	assert.Contains(t, message.TextMessage, "# Hello\n*there*")
+	assert.Contains(t, message.HTMLMessage, "<td>&lt;Jo&gt;</td>")
+	assert.Contains(t, message.HTMLMessage, "<h1>Hello</h1>\n<p><em>there</em></p>")
+
+	target, err = loadTarget("example.yml", []byte(`
+name: example
+to: [admin@my-site.com]
+templates:
+  html: "<div>{{ .message | markdown }}</div>"
+`))
+	assert.NoError(t, err)
+	target.transports = []Transport{transport}
+	_, err = d.SendTarget(target, request)
+	assert.NoError(t, err)
+	assert.Equal(t, "<div><h1>Hello</h1>\n<p><em>there</em></p>\n</div>", transport.messages[1].HTMLMessage)
+}
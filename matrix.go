@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var matrixTxnCounter uint64
+
+// MatrixTransport sends messages to a Matrix room
+type MatrixTransport struct {
+	name     string
+	settings matrixSettings
+	client   *http.Client
+}
+
+type matrixSettings struct {
+	Homeserver  string        `yaml:"homeserver"`
+	Room        string        `yaml:"room"`
+	AccessToken string        `yaml:"access-token"`
+	MsgType     string        `yaml:"msgtype"`
+	Timeout     time.Duration `yaml:"timeout"`
+}
+
+type matrixMessage struct {
+	MsgType       string `json:"msgtype"`
+	Body          string `json:"body"`
+	Format        string `json:"format"`
+	FormattedBody string `json:"formatted_body"`
+}
+
+func newMatrixTransport(d *Dispatch, target DispatchTarget, config OutputConfig) (Transport, error) {
+	t := &MatrixTransport{name: config.Name}
+	s := &t.settings
+	if err := config.decode(s); err != nil {
+		return nil, err
+	}
+	if err := resolveSecrets(&s.AccessToken); err != nil {
+		return nil, err
+	}
+	if len(s.Homeserver) == 0 || len(s.Room) == 0 || len(s.AccessToken) == 0 {
+		return nil, errors.New("a homeserver, room and access-token are required")
+	}
+	if !strings.HasPrefix(s.Room, "!") {
+		return nil, fmt.Errorf("room '%s' must be a room id such as !abc:matrix.org", s.Room)
+	}
+	s.Homeserver = strings.TrimRight(s.Homeserver, "/")
+	if len(s.MsgType) == 0 {
+		s.MsgType = "m.text"
+	}
+	if s.Timeout == 0 {
+		s.Timeout = 10 * time.Second
+	}
+	t.client = &http.Client{Timeout: s.Timeout}
+	return t, nil
+}
+
+// Name returns the output name
+func (t *MatrixTransport) Name() string {
+	return t.name
+}
+
+// Send posts the message to the room
+func (t *MatrixTransport) Send(ctx context.Context, message Message) error {
+	txnID := fmt.Sprintf("dispatch.%d.%d", time.Now().UnixNano(), atomic.AddUint64(&matrixTxnCounter, 1))
+	endpoint := fmt.Sprintf("%s/_matrix/client/v3/rooms/%s/send/m.room.message/%s",
+		t.settings.Homeserver, url.PathEscape(t.settings.Room), url.PathEscape(txnID))
+
+	body, formatted := formatMatrixMessage(message)
+	payload := matrixMessage{
+		MsgType:       t.settings.MsgType,
+		Body:          body,
+		Format:        "org.matrix.custom.html",
+		FormattedBody: formatted,
+	}
+	return doJSON(ctx, t.client, "PUT", endpoint, t.authHeaders(), payload, nil)
+}
+
+// Check verifies the access token with the homeserver
+func (t *MatrixTransport) Check(ctx context.Context) error {
+	endpoint := t.settings.Homeserver + "/_matrix/client/v3/account/whoami"
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
+	if err != nil {
+		return err
+	}
+	for key, value := range t.authHeaders() {
+		req.Header.Set(key, value)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return newHTTPError(resp)
+	}
+	return nil
+}
+
+func (t *MatrixTransport) authHeaders() map[string]string {
+	return map[string]string{"Authorization": "Bearer " + t.settings.AccessToken}
+}
+
+// formatMatrixMessage returns the plain and html bodies of a message. When the
+// target has no html template the text is escaped into html.
+func formatMatrixMessage(message Message) (string, string) {
+	body := strings.TrimSpace(message.TextMessage)
+	formatted := strings.TrimSpace(message.HTMLMessage)
+	if len(formatted) == 0 {
+		formatted = "<pre>" + html.EscapeString(body) + "</pre>"
+	}
+	if len(message.Subject) > 0 {
+		body = message.Subject + "\n\n" + body
+		formatted = "<strong>" + html.EscapeString(message.Subject) + "</strong><br>" + formatted
+	}
+	return body, formatted
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatrixTransport(t *testing.T) {
+	var path, auth, method string
+	var received matrixMessage
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.EscapedPath()
+		auth = r.Header.Get("Authorization")
+		method = r.Method
+		json.NewDecoder(r.Body).Decode(&received)
+		w.Write([]byte(`{"event_id": "$1"}`))
+	}))
+	defer stub.Close()
+
+	transport, err := newMatrixTransport(nil, DispatchTarget{}, OutputConfig{Name: "room", Type: "matrix",
+		Options: map[string]interface{}{
+			"homeserver":   stub.URL + "/",
+			"room":         "!abc:my-site.com",
+			"access-token": "token",
+		}})
+	assert.NoError(t, err)
+
+	err = transport.Send(context.Background(), Message{
+		Subject:     "[dispatch] example",
+		TextMessage: "Hello <b>",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "PUT", method)
+	assert.True(t, strings.HasPrefix(path,
+		"/_matrix/client/v3/rooms/%21abc:my-site.com/send/m.room.message/dispatch."), path)
+	assert.Equal(t, "Bearer token", auth)
+	assert.Equal(t, matrixMessage{
+		MsgType:       "m.text",
+		Body:          "[dispatch] example\n\nHello <b>",
+		Format:        "org.matrix.custom.html",
+		FormattedBody: "<strong>[dispatch] example</strong><br><pre>Hello &lt;b&gt;</pre>",
+	}, received)
+}
+
+func TestMatrixTransportRoomID(t *testing.T) {
+	_, err := newMatrixTransport(nil, DispatchTarget{}, OutputConfig{Name: "room", Type: "matrix",
+		Options: map[string]interface{}{
+			"homeserver":   "https://matrix.org",
+			"room":         "#support:matrix.org",
+			"access-token": "token",
+		}})
+	assert.Error(t, err)
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// smtpTimeout is how long the server has to answer a command, a relay that
+// stops responding would otherwise hold on to its connection forever
+var smtpTimeout = time.Minute
+
+// smtpConn is an open connection to an SMTP server. It implements the gomail
+// SendCloser so messages are written the same way gomail sends them.
+type smtpConn struct {
+	conn     net.Conn
+	client   *smtp.Client
+	sent     int
+	lastUsed time.Time
+}
+
+// extend gives the server smtpTimeout to answer the next command
+func (c *smtpConn) extend() {
+	c.conn.SetDeadline(time.Now().Add(smtpTimeout))
+}
+
+// dialSMTP connects to the relay, upgrading to TLS and authenticating when
+// the server supports it
+func dialSMTP(ctx context.Context, relay SMTPRelaySettings, tokens *oauth2Tokens) (*smtpConn, error) {
+	address := net.JoinHostPort(relay.Host, fmt.Sprint(relay.Port))
+	log.Debugf("Connecting too %s", address)
+	dialer := net.Dialer{Timeout: 10 * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	c := &smtpConn{conn: conn}
+	// the whole handshake, up to and including AUTH, gets one timeout
+	c.extend()
+	//TODO: Add an option to verify the server certificate
+	tlsConfig := &tls.Config{ServerName: relay.Host, InsecureSkipVerify: true}
+	if relay.Port == 465 {
+		conn = tls.Client(conn, tlsConfig)
+	}
+
+	client, err := smtp.NewClient(conn, relay.Host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if relay.Port != 465 {
+		if ok, _ := client.Extension("STARTTLS"); ok {
+			if err := client.StartTLS(tlsConfig); err != nil {
+				client.Close()
+				return nil, err
+			}
+		}
+	}
+
+	if relay.Auth != "none" && (len(relay.Auth) > 0 || len(relay.UserName) > 0) {
+		// a configured mechanism is tried even when the server does not offer it
+		ok, mechanisms := client.Extension("AUTH")
+		if ok || len(relay.Auth) > 0 {
+			auth, err := chooseSMTPAuth(relay, mechanisms, tokens)
+			if err == nil {
+				err = client.Auth(auth)
+			}
+			if err != nil {
+				client.Close()
+				return nil, err
+			}
+		}
+	}
+	c.client = client
+	c.lastUsed = time.Now()
+	return c, nil
+}
+
+// smtpRejection is the reply of a server to the mail transaction itself, as
+// opposed to the connection or authentication failing
+type smtpRejection struct {
+	err error
+}
+
+func (e *smtpRejection) Error() string {
+	return e.err.Error()
+}
+
+func (e *smtpRejection) Unwrap() error {
+	return e.err
+}
+
+// Send sends a message in a single mail transaction
+func (c *smtpConn) Send(from string, to []string, msg io.WriterTo) error {
+	c.lastUsed = time.Now()
+	c.extend()
+	if err := c.client.Mail(from); err != nil {
+		return &smtpRejection{err}
+	}
+	for _, address := range to {
+		c.extend()
+		if err := c.client.Rcpt(address); err != nil {
+			return &smtpRejection{err}
+		}
+	}
+	c.extend()
+	w, err := c.client.Data()
+	if err != nil {
+		return &smtpRejection{err}
+	}
+	if _, err := msg.WriteTo(w); err != nil {
+		w.Close()
+		return err
+	}
+	c.extend()
+	if err := w.Close(); err != nil {
+		return &smtpRejection{err}
+	}
+	c.sent++
+	return nil
+}
+
+// Close ends the session and closes the connection
+func (c *smtpConn) Close() error {
+	c.extend()
+	if err := c.client.Quit(); err != nil {
+		return c.client.Close()
+	}
+	return nil
+}
+
+// smtpPool keeps connections to a relay open between messages
+type smtpPool struct {
+	dial        func(ctx context.Context) (*smtpConn, error)
+	idleTimeout time.Duration
+	maxMessages int
+
+	slots   chan struct{}
+	mutex   sync.Mutex
+	idle    []*smtpConn
+	closed  bool
+	done    chan struct{}
+	expires sync.Once
+}
+
+// newSMTPPool creates a pool of at most size connections. Connections are
+// closed after being idle for idleTimeout or sending maxMessages messages.
+func newSMTPPool(dial func(ctx context.Context) (*smtpConn, error), size int, idleTimeout time.Duration, maxMessages int) *smtpPool {
+	if size <= 0 {
+		size = 1
+	}
+	p := &smtpPool{
+		dial:        dial,
+		idleTimeout: idleTimeout,
+		maxMessages: maxMessages,
+		slots:       make(chan struct{}, size),
+		done:        make(chan struct{}),
+	}
+	return p
+}
+
+// get returns a connection that is ready to send, reusing an idle one when
+// it still answers. Blocks while all of the connections are in use, until
+// the context is done.
+func (p *smtpPool) get(ctx context.Context) (*smtpConn, error) {
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	for {
+		conn := p.pop()
+		if conn == nil {
+			break
+		}
+		// the server may have dropped the connection while it was idle
+		conn.extend()
+		if err := conn.client.Reset(); err != nil {
+			log.Debugf("smtp connection is gone, reconnecting: %v", err)
+			conn.client.Close()
+			continue
+		}
+		return conn, nil
+	}
+	conn, err := p.dial(ctx)
+	if err != nil {
+		<-p.slots
+		return nil, err
+	}
+	return conn, nil
+}
+
+// put returns a connection to the pool once the message was sent. The
+// connection is closed if it failed or has sent enough messages.
+func (p *smtpPool) put(conn *smtpConn, err error) {
+	defer func() { <-p.slots }()
+
+	var smtpErr *textproto.Error
+	reusable := err == nil || errors.As(err, &smtpErr)
+	if !reusable || p.idleTimeout <= 0 || (p.maxMessages > 0 && conn.sent >= p.maxMessages) {
+		if reusable {
+			conn.Close()
+		} else {
+			conn.client.Close()
+		}
+		return
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.closed {
+		conn.Close()
+		return
+	}
+	conn.lastUsed = time.Now()
+	p.idle = append(p.idle, conn)
+	p.expires.Do(func() { go p.expire() })
+}
+
+func (p *smtpPool) pop() *smtpConn {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if len(p.idle) == 0 {
+		return nil
+	}
+	// the most recently used connection is the most likely to still be open
+	conn := p.idle[len(p.idle)-1]
+	p.idle = p.idle[:len(p.idle)-1]
+	return conn
+}
+
+// expire closes connections that have been idle for too long
+func (p *smtpPool) expire() {
+	ticker := time.NewTicker(p.idleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-p.done:
+			return
+		}
+
+		var expired []*smtpConn
+		p.mutex.Lock()
+		idle := p.idle[:0]
+		for _, conn := range p.idle {
+			if time.Since(conn.lastUsed) >= p.idleTimeout {
+				expired = append(expired, conn)
+			} else {
+				idle = append(idle, conn)
+			}
+		}
+		p.idle = idle
+		p.mutex.Unlock()
+
+		for _, conn := range expired {
+			conn.Close()
+		}
+	}
+}
+
+// Close quits the idle connections and stops pooling new ones
+func (p *smtpPool) Close() {
+	p.mutex.Lock()
+	if p.closed {
+		p.mutex.Unlock()
+		return
+	}
+	p.closed = true
+	idle := p.idle
+	p.idle = nil
+	p.mutex.Unlock()
+
+	close(p.done)
+	for _, conn := range idle {
+		conn.Close()
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func (s *testSMTPServer) sessions() int {
+	s.Lock()
+	defer s.Unlock()
+	count := 0
+	for _, command := range s.commands {
+		if command == "EHLO" {
+			count++
+		}
+	}
+	return count
+}
+
+func TestSMTPPoolReuse(t *testing.T) {
+	server := newTestSMTPServer(t, "250 queued")
+	relays := newRelays(SMTPSettings{
+		Relays:      []SMTPRelaySettings{server.relay("primary", 0)},
+		PoolSize:    2,
+		IdleTimeout: time.Minute,
+		MaxMessages: 2,
+	})
+	defer relays.Close()
+
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, relays.Send(context.Background(), newTestRelayMessage(), nil))
+	}
+	assert.Equal(t, 3, server.count())
+	// the first connection is replaced after sending two messages
+	assert.Equal(t, 2, server.sessions())
+}
+
+func TestSMTPPoolReconnect(t *testing.T) {
+	server := newTestSMTPServer(t, "250 queued")
+	relays := newRelays(SMTPSettings{
+		Relays:      []SMTPRelaySettings{server.relay("primary", 0)},
+		IdleTimeout: time.Minute,
+	})
+	defer relays.Close()
+	pool := relays.relays[0].pool
+
+	assert.NoError(t, relays.Send(context.Background(), newTestRelayMessage(), nil))
+	// drop the idle connection behind the pool's back
+	assert.Len(t, pool.idle, 1)
+	pool.idle[0].client.Close()
+
+	assert.NoError(t, relays.Send(context.Background(), newTestRelayMessage(), nil))
+	assert.Equal(t, 2, server.count())
+	assert.Equal(t, 2, server.sessions())
+}
+
+func TestSMTPPoolDisabled(t *testing.T) {
+	server := newTestSMTPServer(t, "250 queued")
+	relays := newRelays(SMTPSettings{Relays: []SMTPRelaySettings{server.relay("primary", 0)}})
+
+	assert.NoError(t, relays.Send(context.Background(), newTestRelayMessage(), nil))
+	assert.Empty(t, relays.relays[0].pool.idle)
+}
+
+func TestSMTPPoolTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { smtpTimeout = timeout }(smtpTimeout)
+	smtpTimeout = 100 * time.Millisecond
+
+	// a server that greets and then stops answering
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			conn.Write([]byte("220 localhost ESMTP\r\n"))
+		}
+	}()
+	port := listener.Addr().(*net.TCPAddr).Port
+	relays := newRelays(SMTPSettings{Relays: []SMTPRelaySettings{{Name: "stuck", Host: "127.0.0.1", Port: port, Weight: 1}}})
+	defer relays.Close()
+
+	start := time.Now()
+	assert.Error(t, relays.Send(context.Background(), newTestRelayMessage(), nil))
+	assert.Less(t, time.Since(start), 5*time.Second)
+
+	// waiting for a connection of a full pool stops with the context
+	pool := relays.relays[0].pool
+	pool.slots <- struct{}{}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = pool.get(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
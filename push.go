@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/Masterminds/sprig/v3"
+)
+
+// pushSettings are shared by the push notification outputs
+type pushSettings struct {
+	Server        string         `yaml:"server"`
+	Priority      *int           `yaml:"priority"`
+	PriorityField string         `yaml:"priority-field"`
+	Priorities    map[string]int `yaml:"priorities"`
+	Click         string         `yaml:"click"`
+	Timeout       time.Duration  `yaml:"timeout"`
+}
+
+// pushNotifier holds what the ntfy and gotify outputs have in common
+type pushNotifier struct {
+	name     string
+	settings pushSettings
+	click    *template.Template
+	client   *http.Client
+}
+
+func (p *pushNotifier) init(name string, minPriority, maxPriority int) error {
+	s := &p.settings
+	p.name = name
+	if len(s.Server) == 0 {
+		return errors.New("a server url is required")
+	}
+	s.Server = strings.TrimRight(s.Server, "/")
+	if s.Priority != nil && (*s.Priority < minPriority || *s.Priority > maxPriority) {
+		return fmt.Errorf("priority must be between %d and %d", minPriority, maxPriority)
+	}
+	priorities := map[string]int{}
+	for value, priority := range s.Priorities {
+		if priority < minPriority || priority > maxPriority {
+			return fmt.Errorf("priority for '%s' must be between %d and %d", value, minPriority, maxPriority)
+		}
+		priorities[strings.ToLower(value)] = priority
+	}
+	s.Priorities = priorities
+	if len(s.Click) > 0 {
+		var err error
+		p.click, err = template.New(name).Funcs(sprig.TxtFuncMap()).Parse(s.Click)
+		if err != nil {
+			return err
+		}
+	}
+	if s.Timeout == 0 {
+		s.Timeout = 10 * time.Second
+	}
+	p.client = &http.Client{Timeout: s.Timeout}
+	return nil
+}
+
+// Name returns the output name
+func (p *pushNotifier) Name() string {
+	return p.name
+}
+
+// Check makes sure the server can be reached, without sending a notification
+func (p *pushNotifier) Check(ctx context.Context) error {
+	return checkURL(ctx, p.client, p.settings.Server)
+}
+
+// priority maps the value of the priority field to a priority. Values that
+// are not listed in priorities can be given as a number.
+func (p *pushNotifier) priority(fields map[string]string, minPriority, maxPriority int) *int {
+	value := strings.ToLower(strings.TrimSpace(fields[p.settings.PriorityField]))
+	if len(p.settings.PriorityField) == 0 || len(value) == 0 {
+		return p.settings.Priority
+	}
+	if priority, found := p.settings.Priorities[value]; found {
+		return &priority
+	}
+	if priority, err := strconv.Atoi(value); err == nil && priority >= minPriority && priority <= maxPriority {
+		return &priority
+	}
+	return p.settings.Priority
+}
+
+// clickURL renders the click url with the request fields
+func (p *pushNotifier) clickURL(fields map[string]string) (string, error) {
+	if p.click == nil {
+		return "", nil
+	}
+	var url bytes.Buffer
+	if err := p.click.Execute(&url, fields); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(url.String()), nil
+}
+
+// NtfyTransport publishes messages to a ntfy topic
+type NtfyTransport struct {
+	pushNotifier
+	topic string
+	token string
+	tags  []string
+}
+
+type ntfySettings struct {
+	pushSettings `yaml:",inline"`
+	Topic        string   `yaml:"topic"`
+	Token        string   `yaml:"token"`
+	Tags         []string `yaml:"tags"`
+}
+
+type ntfyMessage struct {
+	Topic    string   `json:"topic"`
+	Title    string   `json:"title,omitempty"`
+	Message  string   `json:"message"`
+	Priority *int     `json:"priority,omitempty"`
+	Click    string   `json:"click,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+}
+
+func newNtfyTransport(d *Dispatch, target DispatchTarget, config OutputConfig) (Transport, error) {
+	s := ntfySettings{}
+	s.Server = "https://ntfy.sh"
+	if err := config.decode(&s); err != nil {
+		return nil, err
+	}
+	if err := resolveSecrets(&s.Token); err != nil {
+		return nil, err
+	}
+	if len(s.Topic) == 0 {
+		return nil, errors.New("a topic is required")
+	}
+	t := &NtfyTransport{topic: s.Topic, token: s.Token, tags: s.Tags}
+	t.settings = s.pushSettings
+	if err := t.init(config.Name, 1, 5); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Send publishes the message to the topic
+func (t *NtfyTransport) Send(ctx context.Context, message Message) error {
+	click, err := t.clickURL(message.Fields)
+	if err != nil {
+		return err
+	}
+	payload := ntfyMessage{
+		Topic:    t.topic,
+		Title:    message.Subject,
+		Message:  strings.TrimSpace(message.TextMessage),
+		Priority: t.priority(message.Fields, 1, 5),
+		Click:    click,
+		Tags:     t.tags,
+	}
+	headers := map[string]string{}
+	if len(t.token) > 0 {
+		headers["Authorization"] = "Bearer " + t.token
+	}
+	return doJSON(ctx, t.client, "POST", t.settings.Server, headers, payload, nil)
+}
+
+// GotifyTransport sends messages to a Gotify application
+type GotifyTransport struct {
+	pushNotifier
+	token string
+}
+
+type gotifySettings struct {
+	pushSettings `yaml:",inline"`
+	Token        string `yaml:"token"`
+}
+
+type gotifyMessage struct {
+	Title    string                 `json:"title,omitempty"`
+	Message  string                 `json:"message"`
+	Priority *int                   `json:"priority,omitempty"`
+	Extras   map[string]interface{} `json:"extras,omitempty"`
+}
+
+func newGotifyTransport(d *Dispatch, target DispatchTarget, config OutputConfig) (Transport, error) {
+	s := gotifySettings{}
+	if err := config.decode(&s); err != nil {
+		return nil, err
+	}
+	if err := resolveSecrets(&s.Token); err != nil {
+		return nil, err
+	}
+	if len(s.Token) == 0 {
+		return nil, errors.New("an application token is required")
+	}
+	t := &GotifyTransport{token: s.Token}
+	t.settings = s.pushSettings
+	if err := t.init(config.Name, 0, 10); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Send posts the message to the application
+func (t *GotifyTransport) Send(ctx context.Context, message Message) error {
+	click, err := t.clickURL(message.Fields)
+	if err != nil {
+		return err
+	}
+	payload := gotifyMessage{
+		Title:    message.Subject,
+		Message:  strings.TrimSpace(message.TextMessage),
+		Priority: t.priority(message.Fields, 0, 10),
+	}
+	if len(click) > 0 {
+		payload.Extras = map[string]interface{}{
+			"client::notification": map[string]interface{}{"click": map[string]string{"url": click}},
+		}
+	}
+	headers := map[string]string{"X-Gotify-Key": t.token}
+	return doJSON(ctx, t.client, "POST", t.settings.Server+"/message", headers, payload, nil)
+}
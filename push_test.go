@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNtfyTransport(t *testing.T) {
+	var auth string
+	var received ntfyMessage
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		json.NewDecoder(r.Body).Decode(&received)
+		w.Write([]byte(`{"id": "abc"}`))
+	}))
+	defer stub.Close()
+
+	transport, err := newNtfyTransport(nil, DispatchTarget{}, OutputConfig{Name: "phone", Type: "ntfy",
+		Options: map[string]interface{}{
+			"server":         stub.URL,
+			"topic":          "contact",
+			"token":          "tk_secret",
+			"priority":       3,
+			"priority-field": "urgency",
+			"priorities":     map[string]int{"High": 5},
+			"click":          "mailto:{{ .email }}",
+		}})
+	assert.NoError(t, err)
+
+	err = transport.Send(context.Background(), Message{
+		Subject:     "[dispatch] example",
+		TextMessage: "Hello\n",
+		Fields:      map[string]string{"email": "anon@my-site.com", "urgency": "high"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "Bearer tk_secret", auth)
+	priority := 5
+	assert.Equal(t, ntfyMessage{
+		Topic:    "contact",
+		Title:    "[dispatch] example",
+		Message:  "Hello",
+		Priority: &priority,
+		Click:    "mailto:anon@my-site.com",
+	}, received)
+}
+
+func TestGotifyTransport(t *testing.T) {
+	var path, key string
+	var received gotifyMessage
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		key = r.Header.Get("X-Gotify-Key")
+		json.NewDecoder(r.Body).Decode(&received)
+		w.Write([]byte(`{"id": 1}`))
+	}))
+	defer stub.Close()
+
+	transport, err := newGotifyTransport(nil, DispatchTarget{}, OutputConfig{Name: "phone", Type: "gotify",
+		Options: map[string]interface{}{
+			"server":         stub.URL + "/",
+			"token":          "app-token",
+			"priority-field": "urgency",
+		}})
+	assert.NoError(t, err)
+
+	err = transport.Send(context.Background(), Message{
+		Subject:     "[dispatch] example",
+		TextMessage: "Hello",
+		Fields:      map[string]string{"urgency": "8"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "/message", path)
+	assert.Equal(t, "app-token", key)
+	if assert.NotNil(t, received.Priority) {
+		assert.Equal(t, 8, *received.Priority)
+	}
+	assert.Nil(t, received.Extras)
+
+	// 0 is a valid gotify priority and has to be sent
+	received = gotifyMessage{}
+	err = transport.Send(context.Background(), Message{TextMessage: "Hello", Fields: map[string]string{"urgency": "0"}})
+	assert.NoError(t, err)
+	if assert.NotNil(t, received.Priority) {
+		assert.Equal(t, 0, *received.Priority)
+	}
+
+	// without a priority the application default is used
+	received = gotifyMessage{}
+	err = transport.Send(context.Background(), Message{TextMessage: "Hello"})
+	assert.NoError(t, err)
+	assert.Nil(t, received.Priority)
+}
+
+func TestPushPriorityRange(t *testing.T) {
+	_, err := newNtfyTransport(nil, DispatchTarget{}, OutputConfig{Name: "phone", Type: "ntfy",
+		Options: map[string]interface{}{"topic": "contact", "priorities": map[string]int{"high": 8}}})
+	assert.Error(t, err)
+
+	_, err = newGotifyTransport(nil, DispatchTarget{}, OutputConfig{Name: "phone", Type: "gotify",
+		Options: map[string]interface{}{"server": "https://push.my-site.com"}})
+	assert.Error(t, err)
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/mail"
+	"net/textproto"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	gomail "gopkg.in/gomail.v2"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SMTPRelaySettings defines one of several SMTP relays
+type SMTPRelaySettings struct {
+	Name     string `mapstructure:"name"`
+	Host     string `mapstructure:"server"`
+	Port     int    `mapstructure:"port"`
+	UserName string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+	// Auth is the authentication mechanism, picked automatically when empty
+	Auth   string         `mapstructure:"auth"`
+	OAuth2 OAuth2Settings `mapstructure:"oauth2"`
+	// Priority orders the relays, lower priorities are tried first
+	Priority int `mapstructure:"priority"`
+	// Weight spreads messages between relays of the same priority
+	Weight int `mapstructure:"weight"`
+}
+
+// prepareRelays sets the defaults of the relay settings and validates them
+func prepareRelays(relays []SMTPRelaySettings) error {
+	names := map[string]bool{}
+	for i := range relays {
+		r := &relays[i]
+		if len(r.Host) == 0 {
+			return fmt.Errorf("relay %d does not have a server", i+1)
+		}
+		if r.Port == 0 {
+			r.Port = 25
+		}
+		if len(r.Name) == 0 {
+			r.Name = r.Host
+		}
+		if r.Weight < 0 {
+			return fmt.Errorf("relay %s has a negative weight", r.Name)
+		}
+		if r.Weight == 0 {
+			r.Weight = 1
+		}
+		if names[r.Name] {
+			return fmt.Errorf("relay %s is defined more than once", r.Name)
+		}
+		err := resolveSecrets(&r.Password, &r.OAuth2.ClientSecret, &r.OAuth2.RefreshToken)
+		if err != nil {
+			return fmt.Errorf("relay %s: %v", r.Name, err)
+		}
+		r.Auth = strings.ToLower(r.Auth)
+		if err := checkSMTPAuth(*r); err != nil {
+			return fmt.Errorf("relay %s: %v", r.Name, err)
+		}
+		names[r.Name] = true
+	}
+	return nil
+}
+
+// Relay is an SMTP relay along with its health
+type Relay struct {
+	SMTPRelaySettings
+	pool     *smtpPool
+	tokens   *oauth2Tokens
+	mutex    sync.Mutex
+	failures int
+	retryAt  time.Time
+}
+
+// Relays sends messages through the first healthy relay, failing over to the
+// next one when a relay cannot be reached or temporarily rejects a message
+type Relays struct {
+	relays        []*Relay
+	maxFailures   int
+	probeInterval time.Duration
+	inbox         *Inbox
+}
+
+func newRelays(smtp SMTPSettings) *Relays {
+	g := &Relays{
+		maxFailures:   smtp.MaxFailures,
+		probeInterval: smtp.ProbeInterval,
+		inbox:         smtp.Inbox,
+	}
+	if g.maxFailures <= 0 {
+		g.maxFailures = 3
+	}
+	if g.probeInterval <= 0 {
+		g.probeInterval = 30 * time.Second
+	}
+
+	settings := smtp.Relays
+	if len(settings) == 0 {
+		settings = []SMTPRelaySettings{defaultRelay(smtp)}
+	}
+	for _, s := range settings {
+		if s.Weight <= 0 {
+			s.Weight = 1
+		}
+		relay := &Relay{SMTPRelaySettings: s, tokens: newOAuth2Tokens(s.OAuth2)}
+		dial := func(ctx context.Context) (*smtpConn, error) {
+			return dialSMTP(ctx, relay.SMTPRelaySettings, relay.tokens)
+		}
+		relay.pool = newSMTPPool(dial, smtp.PoolSize, smtp.IdleTimeout, smtp.MaxMessages)
+		g.relays = append(g.relays, relay)
+	}
+	return g
+}
+
+// defaultRelay returns the single server of the smtp settings as a relay
+func defaultRelay(smtp SMTPSettings) SMTPRelaySettings {
+	return SMTPRelaySettings{
+		Name:     "default",
+		Host:     smtp.Host,
+		Port:     smtp.Port,
+		UserName: smtp.UserName,
+		Password: smtp.Password,
+		Auth:     smtp.Auth,
+		OAuth2:   smtp.OAuth2,
+		Weight:   1,
+	}
+}
+
+// Close closes the open connections to the relays
+func (g *Relays) Close() {
+	for _, relay := range g.relays {
+		relay.pool.Close()
+	}
+}
+
+// Has returns true if there is a relay with the name
+func (g *Relays) Has(name string) bool {
+	for _, relay := range g.relays {
+		if relay.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Send delivers the message through the named relays, or all of them when
+// no names are given
+func (g *Relays) Send(ctx context.Context, msg *gomail.Message, names []string) error {
+	from, to, err := getEnvelope(msg)
+	if err != nil {
+		return err
+	}
+
+	candidates := g.order(names)
+	relays := g.healthy(ctx, candidates)
+	if len(relays) == 0 {
+		// everything is down, trying is better than not sending at all
+		log.Warnf("no healthy smtp relays, trying all of them")
+		relays = candidates
+	}
+
+	for _, relay := range relays {
+		err = relay.send(ctx, from, to, msg)
+		if err == nil {
+			relay.success()
+			return nil
+		}
+		if isPermanentSMTPError(err) {
+			return err
+		}
+		relay.failure(g.maxFailures, g.probeInterval)
+		log.Warnf("smtp relay %s failed: %v", relay.Name, err)
+	}
+	return err
+}
+
+// Check connects to each of the named relays
+func (g *Relays) Check(ctx context.Context, names []string) error {
+	var failed []string
+	for _, relay := range g.order(names) {
+		if err := relay.probe(ctx); err != nil {
+			failed = append(failed, fmt.Sprintf("relay %s: %v", relay.Name, err))
+		}
+	}
+	if len(failed) > 0 {
+		return errors.New(strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// order returns the named relays by priority, relays with the same priority
+// are shuffled by their weight
+func (g *Relays) order(names []string) []*Relay {
+	var relays []*Relay
+	for _, relay := range g.relays {
+		if len(names) == 0 || contains(names, relay.Name) {
+			relays = append(relays, relay)
+		}
+	}
+
+	// weighted random sampling, a relay with weight 2 is chosen first twice
+	// as often as one with weight 1
+	keys := map[*Relay]float64{}
+	for _, relay := range relays {
+		keys[relay] = -rand.ExpFloat64() / float64(relay.Weight)
+	}
+	sort.SliceStable(relays, func(i, j int) bool {
+		if relays[i].Priority != relays[j].Priority {
+			return relays[i].Priority < relays[j].Priority
+		}
+		return keys[relays[i]] > keys[relays[j]]
+	})
+	return relays
+}
+
+// healthy returns the relays that are up, probing any that are down and due
+// for another try
+func (g *Relays) healthy(ctx context.Context, relays []*Relay) []*Relay {
+	var up []*Relay
+	for _, relay := range relays {
+		switch relay.state(g.maxFailures) {
+		case relayUp:
+			up = append(up, relay)
+		case relayProbe:
+			if err := relay.probe(ctx); err != nil {
+				relay.failure(g.maxFailures, g.probeInterval)
+				log.Debugf("smtp relay %s is still down: %v", relay.Name, err)
+				continue
+			}
+			relay.success()
+			up = append(up, relay)
+		}
+	}
+	return up
+}
+
+const (
+	relayUp = iota
+	relayDown
+	relayProbe
+)
+
+func (r *Relay) state(maxFailures int) int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.failures < maxFailures {
+		return relayUp
+	}
+	if time.Now().Before(r.retryAt) {
+		return relayDown
+	}
+	// only one sender gets to probe the relay
+	r.retryAt = time.Now().Add(time.Minute)
+	return relayProbe
+}
+
+func (r *Relay) success() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.failures > 0 {
+		log.Infof("smtp relay %s is up", r.Name)
+	}
+	r.failures = 0
+}
+
+func (r *Relay) failure(maxFailures int, probeInterval time.Duration) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.failures++
+	if r.failures >= maxFailures {
+		if r.failures == maxFailures {
+			log.Warnf("smtp relay %s is down after %d failures", r.Name, r.failures)
+		}
+		r.retryAt = time.Now().Add(probeInterval)
+	}
+}
+
+func (r *Relay) send(ctx context.Context, from string, to []string, msg *gomail.Message) error {
+	conn, err := r.pool.get(ctx)
+	if err != nil {
+		return err
+	}
+	err = conn.Send(from, to, msg)
+	r.pool.put(conn, err)
+	return err
+}
+
+// probe makes sure the relay answers
+func (r *Relay) probe(ctx context.Context) error {
+	conn, err := r.pool.get(ctx)
+	if err != nil {
+		return err
+	}
+	r.pool.put(conn, nil)
+	return nil
+}
+
+// isPermanentSMTPError returns true when the server rejected the message with
+// a 5xx reply to MAIL, RCPT or DATA, trying another relay would give the same
+// result. A 5xx while connecting or authenticating is a problem of the relay.
+func isPermanentSMTPError(err error) bool {
+	var rejection *smtpRejection
+	var smtpErr *textproto.Error
+	return errors.As(err, &rejection) && errors.As(rejection.err, &smtpErr) && smtpErr.Code >= 500
+}
+
+// getEnvelope returns the envelope sender and recipients of a message
+func getEnvelope(msg *gomail.Message) (string, []string, error) {
+	from := msg.GetHeader("Sender")
+	if len(from) == 0 {
+		from = msg.GetHeader("From")
+	}
+	if len(from) == 0 {
+		return "", nil, errors.New("message does not have a sender")
+	}
+	sender, err := mail.ParseAddress(from[0])
+	if err != nil {
+		return "", nil, err
+	}
+
+	var to []string
+	for _, header := range []string{"To", "Cc", "Bcc"} {
+		for _, value := range msg.GetHeader(header) {
+			address, err := mail.ParseAddress(value)
+			if err != nil {
+				return "", nil, err
+			}
+			if !contains(to, address.Address) {
+				to = append(to, address.Address)
+			}
+		}
+	}
+	return sender.Address, to, nil
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
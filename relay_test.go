@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	gomail "gopkg.in/gomail.v2"
+)
+
+// testSMTPServer is a minimal SMTP server that answers the DATA command with
+// a fixed reply
+type testSMTPServer struct {
+	sync.Mutex
+	listener net.Listener
+	reply    string
+	messages int
+	commands []string
+	auth     string
+	// authReply replaces the reply to AUTH when set
+	authReply string
+}
+
+func newTestSMTPServer(t *testing.T, reply string) *testSMTPServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	s := &testSMTPServer{listener: listener, reply: reply}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *testSMTPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	conn.Write([]byte("220 localhost ESMTP\r\n"))
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		command := strings.ToUpper(strings.Fields(line + " ")[0])
+		s.Lock()
+		s.commands = append(s.commands, command)
+		s.Unlock()
+		switch command {
+		case "EHLO", "HELO":
+			conn.Write([]byte("250-localhost\r\n250-AUTH PLAIN LOGIN XOAUTH2\r\n250 8BITMIME\r\n"))
+		case "AUTH":
+			s.Lock()
+			s.auth = strings.TrimSpace(line)
+			reply := s.authReply
+			s.Unlock()
+			if len(reply) == 0 {
+				reply = "235 accepted"
+			}
+			conn.Write([]byte(reply + "\r\n"))
+		case "DATA":
+			conn.Write([]byte("354 go ahead\r\n"))
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil || line == ".\r\n" {
+					break
+				}
+			}
+			s.Lock()
+			reply := s.reply
+			if strings.HasPrefix(reply, "250") {
+				s.messages++
+			}
+			s.Unlock()
+			conn.Write([]byte(reply + "\r\n"))
+		case "QUIT":
+			conn.Write([]byte("221 bye\r\n"))
+			return
+		default:
+			conn.Write([]byte("250 ok\r\n"))
+		}
+	}
+}
+
+func (s *testSMTPServer) relay(name string, priority int) SMTPRelaySettings {
+	addr := s.listener.Addr().(*net.TCPAddr)
+	return SMTPRelaySettings{Name: name, Host: "127.0.0.1", Port: addr.Port, Priority: priority, Weight: 1}
+}
+
+func (s *testSMTPServer) count() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.messages
+}
+
+func newTestRelayMessage() *gomail.Message {
+	msg := gomail.NewMessage()
+	msg.SetHeader("From", "dispatch@my-site.com")
+	msg.SetHeader("To", "admin@my-site.com")
+	msg.SetBody("text/plain", "Hello")
+	return msg
+}
+
+func TestRelaysFailover(t *testing.T) {
+	primary := newTestSMTPServer(t, "451 try again later")
+	backup := newTestSMTPServer(t, "250 queued")
+	relays := newRelays(SMTPSettings{
+		Relays:        []SMTPRelaySettings{primary.relay("primary", 0), backup.relay("backup", 1)},
+		MaxFailures:   2,
+		ProbeInterval: time.Hour,
+	})
+
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, relays.Send(context.Background(), newTestRelayMessage(), nil))
+	}
+	assert.Equal(t, 3, backup.count())
+	assert.Equal(t, relayDown, relays.relays[0].state(2))
+
+	// a relay can be picked for a target
+	err := relays.Send(context.Background(), newTestRelayMessage(), []string{"primary"})
+	assert.Error(t, err)
+}
+
+func TestRelaysPermanentError(t *testing.T) {
+	primary := newTestSMTPServer(t, "550 no such user")
+	backup := newTestSMTPServer(t, "250 queued")
+	relays := newRelays(SMTPSettings{
+		Relays: []SMTPRelaySettings{primary.relay("primary", 0), backup.relay("backup", 1)},
+	})
+
+	err := relays.Send(context.Background(), newTestRelayMessage(), nil)
+	assert.True(t, isPermanentSMTPError(err))
+	assert.Equal(t, 0, backup.count())
+	assert.Equal(t, relayUp, relays.relays[0].state(3))
+}
+
+func TestRelaysAuthError(t *testing.T) {
+	primary := newTestSMTPServer(t, "250 queued")
+	primary.authReply = "535 bad credentials"
+	backup := newTestSMTPServer(t, "250 queued")
+	settings := primary.relay("primary", 0)
+	settings.UserName = "dispatch"
+	settings.Password = "wrong"
+	relays := newRelays(SMTPSettings{
+		Relays:        []SMTPRelaySettings{settings, backup.relay("backup", 1)},
+		MaxFailures:   1,
+		ProbeInterval: time.Hour,
+	})
+
+	// a relay that can't be logged in to is skipped, not the message
+	err := relays.Send(context.Background(), newTestRelayMessage(), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, backup.count())
+	assert.Equal(t, relayDown, relays.relays[0].state(1))
+}
+
+func TestRelaysProbe(t *testing.T) {
+	primary := newTestSMTPServer(t, "250 queued")
+	relays := newRelays(SMTPSettings{
+		Relays:        []SMTPRelaySettings{primary.relay("primary", 0)},
+		MaxFailures:   1,
+		ProbeInterval: time.Millisecond,
+	})
+	relays.relays[0].failure(1, time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	assert.NoError(t, relays.Send(context.Background(), newTestRelayMessage(), nil))
+	assert.Equal(t, relayUp, relays.relays[0].state(1))
+}
+
+func TestPrepareRelays(t *testing.T) {
+	relays := []SMTPRelaySettings{{Host: "mail.my-site.com"}}
+	assert.NoError(t, prepareRelays(relays))
+	assert.Equal(t, SMTPRelaySettings{Name: "mail.my-site.com", Host: "mail.my-site.com", Port: 25, Weight: 1}, relays[0])
+
+	assert.Error(t, prepareRelays([]SMTPRelaySettings{{Name: "a", Host: "a"}, {Name: "a", Host: "b"}}))
+	assert.Error(t, prepareRelays([]SMTPRelaySettings{{Name: "a"}}))
+}
+
+func TestGetEnvelope(t *testing.T) {
+	msg := newTestRelayMessage()
+	msg.SetHeader("Cc", "Support <support@my-site.com>", "admin@my-site.com")
+	from, to, err := getEnvelope(msg)
+	assert.NoError(t, err)
+	assert.Equal(t, "dispatch@my-site.com", from)
+	assert.Equal(t, []string{"admin@my-site.com", "support@my-site.com"}, to)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+// TargetRoute sends the submissions matching all of its conditions to its
+// own recipients and outputs. Routes are tried in order, a route without
+// conditions matches everything and is used as the fallback.
+type TargetRoute struct {
+	Name          string           `yaml:"name"`
+	When          []RouteCondition `yaml:"when"`
+	To            []string         `yaml:"to"`
+	Cc            []string         `yaml:"cc"`
+	Bcc           []string         `yaml:"bcc"`
+	SubjectPrefix string           `yaml:"subject-prefix"`
+	// Outputs are the names of the target outputs to deliver too, all of
+	// them when empty
+	Outputs []string `yaml:"outputs"`
+
+	transports []Transport
+}
+
+// RouteCondition matches a request field. Only one of equals, regex or
+// present can be set.
+type RouteCondition struct {
+	Field   string  `yaml:"field"`
+	Equals  *string `yaml:"equals"`
+	Regex   string  `yaml:"regex"`
+	Present *bool   `yaml:"present"`
+
+	regex *regexp.Regexp
+}
+
+// prepareRoutes validates the routes and formats their recipients
+func prepareRoutes(routes []TargetRoute) error {
+	names := map[string]bool{}
+	for i := range routes {
+		r := &routes[i]
+		if len(r.Name) == 0 {
+			r.Name = fmt.Sprintf("%d", i+1)
+		}
+		if names[r.Name] {
+			return fmt.Errorf("route '%s' is defined more than once", r.Name)
+		}
+		names[r.Name] = true
+		if len(r.When) == 0 && i < len(routes)-1 {
+			return fmt.Errorf("route '%s' matches everything, the routes after it are never used", r.Name)
+		}
+
+		for j := range r.When {
+			if err := r.When[j].prepare(); err != nil {
+				return fmt.Errorf("route '%s' condition %d: %v", r.Name, j+1, err)
+			}
+		}
+
+		var err error
+		if r.To, err = formatEmailList(r.To); err != nil {
+			return fmt.Errorf("route '%s' to: %v", r.Name, err)
+		}
+		if r.Cc, err = formatEmailList(r.Cc); err != nil {
+			return fmt.Errorf("route '%s' cc: %v", r.Name, err)
+		}
+		if r.Bcc, err = formatEmailList(r.Bcc); err != nil {
+			return fmt.Errorf("route '%s' bcc: %v", r.Name, err)
+		}
+	}
+	return nil
+}
+
+func (c *RouteCondition) prepare() error {
+	if len(c.Field) == 0 {
+		return errors.New("a field is required")
+	}
+	set := 0
+	if c.Equals != nil {
+		set++
+	}
+	if len(c.Regex) > 0 {
+		set++
+		var err error
+		if c.regex, err = regexp.Compile(c.Regex); err != nil {
+			return fmt.Errorf("regex: %v", err)
+		}
+	}
+	if c.Present != nil {
+		set++
+	}
+	if set != 1 {
+		return errors.New("exactly one of equals, regex or present is required")
+	}
+	return nil
+}
+
+// matches returns true if the request fields satisfy the condition
+func (c *RouteCondition) matches(fields map[string]string) bool {
+	value, found := fields[c.Field]
+	switch {
+	case c.Equals != nil:
+		return found && value == *c.Equals
+	case c.regex != nil:
+		return found && c.regex.MatchString(value)
+	case c.Present != nil:
+		return (found && len(value) > 0) == *c.Present
+	}
+	return false
+}
+
+// matches returns true if the request fields satisfy all of the conditions
+func (r *TargetRoute) matches(fields map[string]string) bool {
+	for i := range r.When {
+		if !r.When[i].matches(fields) {
+			return false
+		}
+	}
+	return true
+}
+
+// resolveRouteOutputs finds the transports of the outputs named by the routes
+func resolveRouteOutputs(routes []TargetRoute, transports []Transport) error {
+	for i := range routes {
+		r := &routes[i]
+		r.transports = nil
+		if len(r.Outputs) == 0 {
+			r.transports = transports
+			continue
+		}
+		for _, name := range r.Outputs {
+			var found Transport
+			for _, transport := range transports {
+				if transport.Name() == name {
+					found = transport
+					break
+				}
+			}
+			if found == nil {
+				return fmt.Errorf("route '%s' output '%s' does not exist", r.Name, name)
+			}
+			r.transports = append(r.transports, found)
+		}
+	}
+	return nil
+}
+
+// route returns the first route matching the request fields, or nil when
+// the target settings are used
+func (t DispatchTarget) route(fields map[string]string) *TargetRoute {
+	for i := range t.Routes {
+		if t.Routes[i].matches(fields) {
+			return &t.Routes[i]
+		}
+	}
+	return nil
+}
+
+// hasFallback returns true if the submissions that match none of the
+// conditional routes have someone to email, or are only sent to outputs
+// that don't need recipients
+func (t DispatchTarget) hasFallback() bool {
+	recipients := len(t.To) + len(t.Cc) + len(t.Bcc)
+	var names []string
+	if len(t.Routes) > 0 {
+		if last := t.Routes[len(t.Routes)-1]; len(last.When) == 0 {
+			if len(last.To)+len(last.Cc)+len(last.Bcc) > 0 {
+				recipients = len(last.To) + len(last.Cc) + len(last.Bcc)
+			}
+			names = last.Outputs
+		}
+	}
+	if recipients > 0 {
+		return true
+	}
+	for _, name := range t.emailOutputs() {
+		if len(names) == 0 || contains(names, name) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoutes(t *testing.T) {
+	data := []byte(`
+name: contact
+to: [admin@my-site.com]
+routes:
+  - name: sales
+    when:
+      - field: department
+        equals: sales
+    to: [sales@my-site.com]
+    subject-prefix: "[Sales]"
+    outputs: [chat]
+  - name: urgent
+    when:
+      - field: priority
+        regex: "^(high|urgent)$"
+      - field: phone
+        present: true
+    cc: [oncall@my-site.com]
+  - name: fallback
+    to: [support@my-site.com]
+`)
+	target, err := loadTarget("contact.yml", data)
+	assert.NoError(t, err)
+
+	email := &testTransport{name: "email"}
+	chat := &testTransport{name: "chat"}
+	target.transports = []Transport{email, chat}
+	assert.NoError(t, resolveRouteOutputs(target.Routes, target.transports))
+
+	d := NewDispatch(t.TempDir(), SMTPSettings{})
+	_, err = d.SendTarget(target, DispatchRequest{"department": "sales", "subject": "hi"})
+	assert.NoError(t, err)
+	assert.Len(t, email.messages, 0)
+	if assert.Len(t, chat.messages, 1) {
+		assert.Equal(t, []string{"sales@my-site.com"}, chat.messages[0].ToAddressList)
+		assert.Equal(t, "[Sales] [dispatch] contact - hi", chat.messages[0].Subject)
+	}
+
+	_, err = d.SendTarget(target, DispatchRequest{"priority": "urgent", "phone": "555-0100"})
+	assert.NoError(t, err)
+	if assert.Len(t, email.messages, 1) {
+		assert.Empty(t, email.messages[0].ToAddressList)
+		assert.Equal(t, []string{"oncall@my-site.com"}, email.messages[0].CcAddressList)
+	}
+
+	_, err = d.SendTarget(target, DispatchRequest{"priority": "urgent"})
+	assert.NoError(t, err)
+	if assert.Len(t, email.messages, 2) {
+		assert.Equal(t, []string{"support@my-site.com"}, email.messages[1].ToAddressList)
+	}
+
+	err = resolveRouteOutputs(target.Routes, []Transport{email})
+	assert.EqualError(t, err, "route 'sales' output 'chat' does not exist")
+}
+
+func TestRouteValidation(t *testing.T) {
+	invalid := []string{
+		`routes: [{when: [{field: a}]}]`,
+		`routes: [{when: [{field: a, equals: b, present: true}]}]`,
+		`routes: [{when: [{equals: b}]}]`,
+		`routes: [{when: [{field: a, regex: "("}]}]`,
+		`routes: [{to: [admin@my-site.com]}, {when: [{field: a, present: true}]}]`,
+		`routes: [{name: a, when: [{field: a, present: true}]}, {name: a}]`,
+		`routes: [{to: [not an address]}]`,
+		`routes: [{when: [{field: a, present: true}], to: [admin@my-site.com]}]`,
+		`routes: [{when: [{field: a, present: true}], to: [admin@my-site.com]}, {outputs: [smtp]}]`,
+		`{outputs: [{type: smtp}, {name: chat, type: slack}], routes: [{when: [{field: a, present: true}], to: [admin@my-site.com], outputs: [smtp]}]}`,
+		`{outputs: [{type: sendmail}], routes: [{when: [{field: a, present: true}], to: [admin@my-site.com]}]}`,
+	}
+	for _, data := range invalid {
+		_, err := loadTarget("example.yml", []byte(data))
+		assert.Error(t, err, data)
+	}
+
+	// routes that only pick chat outputs don't need anyone to email
+	valid := []string{
+		`{outputs: [{type: slack}, {type: ntfy}], routes: [{when: [{field: a, present: true}], outputs: [ntfy]}]}`,
+		`{outputs: [{type: smtp}, {name: chat, type: slack}], routes: [{when: [{field: a, present: true}], to: [admin@my-site.com]}, {outputs: [chat]}]}`,
+	}
+	for _, data := range valid {
+		_, err := loadTarget("example.yml", []byte(data))
+		assert.NoError(t, err, data)
+	}
+
+	target, err := loadTarget("example.yml", []byte(`{to: [admin@my-site.com], routes: [{when: [{field: phone, present: false}]}]}`))
+	assert.NoError(t, err)
+	assert.NotNil(t, target.route(map[string]string{"phone": ""}))
+	assert.Nil(t, target.route(map[string]string{"phone": "555-0100"}))
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const (
+	secretFilePrefix = "file:"
+	secretEnvPrefix  = "env:"
+)
+
+// resolveSecret returns the value of a secret. Values starting with file: are
+// read from that file and values starting with env: from that environment
+// variable, anything else is used as is.
+func resolveSecret(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, secretFilePrefix):
+		path := strings.TrimPrefix(value, secretFilePrefix)
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("could not read secret: %v", err)
+		}
+		// secret files usually end with a newline that is not part of the secret
+		return strings.TrimRight(string(data), "\r\n"), nil
+	case strings.HasPrefix(value, secretEnvPrefix):
+		name := strings.TrimPrefix(value, secretEnvPrefix)
+		secret, found := os.LookupEnv(name)
+		if !found {
+			return "", fmt.Errorf("secret environment variable %s is not set", name)
+		}
+		return secret, nil
+	}
+	return value, nil
+}
+
+// resolveSecrets resolves each of the secrets in place
+func resolveSecrets(values ...*string) error {
+	for _, value := range values {
+		secret, err := resolveSecret(*value)
+		if err != nil {
+			return err
+		}
+		*value = secret
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveSecret(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "password")
+	ioutil.WriteFile(path, []byte("hunter2\n"), 0600)
+	os.Setenv("DISPATCH_TEST_SECRET", "s3cret")
+	defer os.Unsetenv("DISPATCH_TEST_SECRET")
+
+	secret, err := resolveSecret("file:" + path)
+	assert.NoError(t, err)
+	assert.Equal(t, "hunter2", secret)
+
+	secret, err = resolveSecret("env:DISPATCH_TEST_SECRET")
+	assert.NoError(t, err)
+	assert.Equal(t, "s3cret", secret)
+
+	secret, err = resolveSecret("plain-token")
+	assert.NoError(t, err)
+	assert.Equal(t, "plain-token", secret)
+
+	_, err = resolveSecret("env:DISPATCH_TEST_MISSING")
+	assert.Error(t, err)
+	_, err = resolveSecret("file:" + path + ".missing")
+	assert.Error(t, err)
+}
+
+func TestTargetSecrets(t *testing.T) {
+	os.Setenv("DISPATCH_TEST_TOKEN", "abc123")
+	defer os.Unsetenv("DISPATCH_TEST_TOKEN")
+
+	target, err := loadTarget("example", []byte("auth-token: env:DISPATCH_TEST_TOKEN\nto: [admin@my-site.com]\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, "abc123", target.AuthToken)
+}
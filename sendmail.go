@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const defaultSendmailCommand = "/usr/sbin/sendmail -t -i"
+
+// sendmailMaxStderr limits how much of the command error output is kept
+const sendmailMaxStderr = 512
+
+// sendmailValueFlags are the sendmail options that take a value, which can be
+// attached to the flag as in -fdispatch@my-site.com
+const sendmailValueFlags = "BCFLNORVXbfhopr"
+
+// SendmailTransport pipes messages to a local mail command
+type SendmailTransport struct {
+	name     string
+	settings sendmailSettings
+	args     []string
+	// envelope passes the recipients as arguments, for sendmail without -t
+	envelope bool
+}
+
+type sendmailSettings struct {
+	Command string        `yaml:"command"`
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+func newSendmailTransport(d *Dispatch, target DispatchTarget, config OutputConfig) (Transport, error) {
+	if !target.hasRecipients() {
+		return nil, errors.New("target does not have a destination")
+	}
+	t := &SendmailTransport{name: config.Name}
+	s := &t.settings
+	if err := config.decode(s); err != nil {
+		return nil, err
+	}
+	if len(s.Command) == 0 {
+		s.Command = defaultSendmailCommand
+	}
+	t.args = strings.Fields(s.Command)
+	if len(t.args) == 0 {
+		return nil, errors.New("a command is required")
+	}
+	if s.Timeout == 0 {
+		s.Timeout = 30 * time.Second
+	}
+	// only sendmail takes the recipients as arguments, pipe commands get the
+	// message as is
+	t.envelope = config.Type == "sendmail" && !hasShortFlag(t.args[1:], 't')
+	return t, nil
+}
+
+// hasShortFlag returns true if the flag is set in the arguments, alone or in
+// a group like -ti
+func hasShortFlag(args []string, flag byte) bool {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			return false
+		}
+		if len(arg) < 2 || arg[0] != '-' || arg[1] == '-' {
+			continue
+		}
+		for j := 1; j < len(arg); j++ {
+			if arg[j] == flag {
+				return true
+			}
+			if strings.IndexByte(sendmailValueFlags, arg[j]) >= 0 {
+				// the rest of the group, or the next argument, is the value
+				if j == len(arg)-1 {
+					i++
+				}
+				break
+			}
+		}
+	}
+	return false
+}
+
+// Name returns the output name
+func (t *SendmailTransport) Name() string {
+	return t.name
+}
+
+// Send writes the message to the stdin of the command
+func (t *SendmailTransport) Send(ctx context.Context, message Message) error {
+	msg, err := buildMessage(message)
+	if err != nil {
+		return err
+	}
+	args := t.args[1:]
+	var stdin bytes.Buffer
+	if t.envelope {
+		// without -t sendmail reads the recipients from the arguments, and
+		// the Bcc header must not end up in the message
+		_, to, err := getEnvelope(msg)
+		if err != nil {
+			return err
+		}
+		args = append(append(append([]string{}, args...), "--"), to...)
+	} else if bcc := msg.GetHeader("Bcc"); len(bcc) > 0 {
+		// gomail leaves out the Bcc header, sendmail -t needs it to find the
+		// recipients and removes it itself
+		stdin.WriteString("Bcc: " + strings.Join(bcc, ", ") + "\r\n")
+	}
+	if _, err := msg.WriteTo(&stdin); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, t.settings.Timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, t.args[0], args...)
+	cmd.Stdin = &stdin
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return commandError(t.args[0], err, stderr.Bytes())
+	}
+	return nil
+}
+
+// Check makes sure the command can be run
+func (t *SendmailTransport) Check(ctx context.Context) error {
+	_, err := exec.LookPath(t.args[0])
+	return err
+}
+
+// commandError adds the exit status and error output of a command to err
+func commandError(command string, err error, stderr []byte) error {
+	if len(stderr) > sendmailMaxStderr {
+		stderr = stderr[:sendmailMaxStderr]
+	}
+	output := strings.TrimSpace(string(stderr))
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() >= 0 {
+		err = fmt.Errorf("exited with status %d", exitErr.ExitCode())
+	}
+	if len(output) > 0 {
+		return fmt.Errorf("%s %v: %s", command, err, output)
+	}
+	return fmt.Errorf("%s %v", command, err)
+}
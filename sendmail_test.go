@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSendmailTransport(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "message.eml")
+	transport, err := newSendmailTransport(nil, DispatchTarget{To: []string{"admin@my-site.com"}},
+		OutputConfig{Name: "archive", Type: "pipe", Options: map[string]interface{}{
+			"command": "tee " + output,
+		}})
+	assert.NoError(t, err)
+
+	err = transport.Send(context.Background(), Message{
+		FromAddress:    "dispatch@my-site.com",
+		ToAddressList:  []string{"admin@my-site.com"},
+		BccAddressList: []string{"archive@my-site.com"},
+		Subject:        "[dispatch] example",
+		TextMessage:    "Hello",
+	})
+	assert.NoError(t, err)
+
+	data, err := ioutil.ReadFile(output)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(data), "Bcc: archive@my-site.com\r\n"))
+	assert.Contains(t, string(data), "To: admin@my-site.com\r\n")
+	assert.Contains(t, string(data), "Subject: [dispatch] example\r\n")
+	assert.True(t, strings.HasSuffix(string(data), "Hello"))
+	// the pipe command is run as configured, without the recipients
+	assert.Equal(t, []string{"tee", output}, transport.(*SendmailTransport).args)
+	assert.NoFileExists(t, "admin@my-site.com")
+	assert.NoFileExists(t, "archive@my-site.com")
+}
+
+func TestSendmailTransportRecipients(t *testing.T) {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "sendmail")
+	ioutil.WriteFile(script, []byte("#!/bin/sh\necho \"$@\" > "+dir+"/args\ncat > "+dir+"/message.eml\n"), 0755)
+	message := Message{
+		FromAddress:    "dispatch@my-site.com",
+		ToAddressList:  []string{"admin@my-site.com"},
+		BccAddressList: []string{"archive@my-site.com"},
+		Subject:        "[dispatch] example",
+		TextMessage:    "Hello",
+	}
+
+	tests := []struct {
+		command string
+		args    string
+		bcc     bool
+	}{
+		// sendmail -t reads the recipients, including Bcc, from the headers
+		{"-t -i", "-t -i", true},
+		{"-ti", "-ti", true},
+		{"-i -f dispatch@my-site.com -t", "-i -f dispatch@my-site.com -t", true},
+		// otherwise they are passed as arguments and Bcc stays hidden
+		{"-i", "-i -- admin@my-site.com archive@my-site.com", false},
+		{"-i -fdispatch@my-site.com", "-i -fdispatch@my-site.com -- admin@my-site.com archive@my-site.com", false},
+		{"-i -f test@my-site.com", "-i -f test@my-site.com -- admin@my-site.com archive@my-site.com", false},
+	}
+	for _, test := range tests {
+		transport, err := newSendmailTransport(nil, DispatchTarget{To: []string{"admin@my-site.com"}},
+			OutputConfig{Name: "sendmail", Type: "sendmail", Options: map[string]interface{}{
+				"command": script + " " + test.command,
+			}})
+		assert.NoError(t, err)
+		assert.NoError(t, transport.Send(context.Background(), message))
+
+		args, err := ioutil.ReadFile(filepath.Join(dir, "args"))
+		assert.NoError(t, err)
+		assert.Equal(t, test.args+"\n", string(args), test.command)
+		data, err := ioutil.ReadFile(filepath.Join(dir, "message.eml"))
+		assert.NoError(t, err)
+		assert.Equal(t, test.bcc, strings.HasPrefix(string(data), "Bcc: archive@my-site.com\r\n"), test.command)
+		assert.Contains(t, string(data), "To: admin@my-site.com\r\n")
+	}
+}
+
+func TestSendmailTransportError(t *testing.T) {
+	script := filepath.Join(t.TempDir(), "sendmail")
+	ioutil.WriteFile(script, []byte("#!/bin/sh\necho 'unknown user' >&2\nexit 67\n"), 0755)
+
+	transport, err := newSendmailTransport(nil, DispatchTarget{To: []string{"admin@my-site.com"}},
+		OutputConfig{Name: "sendmail", Type: "sendmail", Options: map[string]interface{}{
+			"command": script + " -t -i",
+		}})
+	assert.NoError(t, err)
+
+	err = transport.Send(context.Background(), Message{
+		ToAddressList: []string{"admin@my-site.com"},
+		TextMessage:   "Hello",
+	})
+	assert.EqualError(t, err, script+" exited with status 67: unknown user")
+}
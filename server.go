@@ -1,13 +1,20 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"math"
 	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/didip/tollbooth/v6"
@@ -17,13 +24,23 @@ import (
 
 // Server is the dispatch server
 type Server struct {
-	dispatch *Dispatch
+	dispatch        *Dispatch
+	tlsSettings     TLSSettings
+	tlsConfig       *tls.Config
+	certReloader    *certReloader
+	shutdownTimeout time.Duration
+	socketMode      os.FileMode
 }
 
+// ErrShutdownTimeout is returned when in-flight requests and deliveries did
+// not finish before the shutdown timeout
+var ErrShutdownTimeout = errors.New("timed out waiting for in-flight requests")
+
 // NewServer creates a new dispatch server
 func NewServer(dispatch *Dispatch, limitMax float64, limitTTL time.Duration) *Server {
 	s := new(Server)
 	s.dispatch = dispatch
+	s.shutdownTimeout = 30 * time.Second
 
 	// setup a rate limiter if needed
 	if limitMax != math.MaxFloat64 {
@@ -43,10 +60,135 @@ func NewServer(dispatch *Dispatch, limitMax float64, limitTTL time.Duration) *Se
 	return s
 }
 
-// Run the server
-func (s Server) Run(address string) {
-	log.Infof("starting webserver on %s", address)
-	log.Fatal(http.ListenAndServe(address, WriteLogHandler(http.DefaultServeMux)))
+// SetShutdownTimeout sets how long to wait for in-flight requests on shutdown
+func (s *Server) SetShutdownTimeout(timeout time.Duration) {
+	s.shutdownTimeout = timeout
+}
+
+// SetSocketMode sets the permissions of a unix socket the server listens on
+func (s *Server) SetSocketMode(mode os.FileMode) {
+	s.socketMode = mode
+}
+
+// EnableInbox serves the captured messages on /dev/inbox
+func (s *Server) EnableInbox(inbox *Inbox) {
+	log.Warnf("capturing messages instead of sending them, see %s", inboxPath)
+	http.Handle(inboxPath, inbox)
+	http.Handle(inboxPath+"/", inbox)
+}
+
+// EnableTLS configures the server to serve HTTPS
+func (s *Server) EnableTLS(settings TLSSettings) error {
+	config, reloader, err := newTLSConfig(settings)
+	if err != nil {
+		return err
+	}
+	s.tlsSettings = settings
+	s.tlsConfig = config
+	s.certReloader = reloader
+	return nil
+}
+
+// Run the server until it receives a SIGINT or SIGTERM, then stop accepting
+// connections and wait for in-flight requests and deliveries to finish
+func (s Server) Run(address string) error {
+	server := &http.Server{
+		Addr:    address,
+		Handler: WriteLogHandler(http.DefaultServeMux),
+	}
+	servers := []*http.Server{server}
+	errs := make(chan error, 2)
+
+	// prefer sockets handed to us by systemd socket activation
+	listeners, err := systemdListeners()
+	if err != nil {
+		return err
+	}
+	var listener net.Listener
+	if len(listeners) > 0 {
+		listener = listeners[0]
+		address = listenerAddress(listener)
+		log.Debugf("using %d socket(s) from systemd", len(listeners))
+	} else {
+		listener, err = listen(address, s.socketMode)
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.tlsConfig != nil {
+		log.Infof("starting webserver on https://%s", address)
+		if s.tlsConfig.ClientCAs != nil {
+			log.Infof("requiring client certificates signed by %s", s.tlsSettings.ClientCAFile)
+		}
+		server.TLSConfig = s.tlsConfig
+		go s.certReloader.Watch()
+		if s.tlsSettings.RedirectPort > 0 || len(listeners) > 1 {
+			redirect, redirectListener, err := s.newRedirectServer(address, listeners)
+			if err != nil {
+				return err
+			}
+			servers = append(servers, redirect)
+			log.Infof("starting https redirect on %s", redirectListener.Addr())
+			go func() { errs <- redirect.Serve(redirectListener) }()
+		}
+		// certificates are served by the reloader
+		go func() { errs <- server.ServeTLS(listener, "", "") }()
+	} else {
+		log.Infof("starting webserver on %s", address)
+		go func() { errs <- server.Serve(listener) }()
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(stop)
+
+	select {
+	case err := <-errs:
+		return err
+	case sig := <-stop:
+		log.Infof("received %s, shutting down (timeout %s)", sig, s.shutdownTimeout)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout)
+	defer cancel()
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			return ErrShutdownTimeout
+		}
+	}
+	if err := s.dispatch.Wait(ctx); err != nil {
+		return ErrShutdownTimeout
+	}
+	s.dispatch.Close()
+	log.Infof("webserver stopped")
+	return nil
+}
+
+func (s Server) newRedirectServer(address string, listeners []net.Listener) (*http.Server, net.Listener, error) {
+	if isUnixAddress(address) {
+		return nil, nil, errors.New("an https redirect requires a tcp address")
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, nil, err
+	}
+	httpsPort, _ := strconv.Atoi(port)
+
+	// a second socket from systemd is used for the redirect
+	var listener net.Listener
+	if len(listeners) > 1 {
+		listener = listeners[1]
+	} else {
+		listener, err = listen(net.JoinHostPort(host, strconv.Itoa(s.tlsSettings.RedirectPort)), 0)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	server := &http.Server{
+		Handler: WriteLogHandler(redirectHandler(httpsPort)),
+	}
+	return server, listener, nil
 }
 
 type statusWriter struct {
@@ -138,17 +280,39 @@ func send(w http.ResponseWriter, r *http.Request) {
 		formattedMsg[strings.ToLower(key)] = val
 	}
 	requestData = formattedMsg
-	requestData["timestamp"] = recvTime.Format("Jan 02, 2006 15:04:05 UTC")
 
 	headerData := getHeaderValues(r.Header)
 
 	requestData = DispatchRequest(mergeRequests(headerData, requestData))
+	// the timestamp fields are formatted for the target when it is sent
+	requestData["timestamp_iso"] = recvTime.Format(time.RFC3339Nano)
+
+	var target DispatchTarget
+	certAuth := false
+	if cert := getClientCert(r); cert != nil {
+		target, certAuth = dispatch.AuthenticateCert(cert)
+	}
 
-	if _, ok := requestData["auth-token"]; !ok {
+	bearer := getBearerToken(r.Header)
+	if _, ok := requestData["auth-token"]; !ok && len(bearer) == 0 && !certAuth {
 		respondError(w, r, 400, "'auth-token' missing")
 		return
 	}
 
+	bearerAuth := false
+	if !certAuth && len(bearer) > 0 {
+		var claims DispatchRequest
+		target, claims, err = dispatch.AuthenticateJWT(bearer)
+		if err != nil {
+			respondError(w, r, 401, "%v", err)
+			return
+		}
+		// claims are trusted, so they override anything the client sent,
+		// but are validated the same way
+		requestData = DispatchRequest(mergeRequests(claims, requestData))
+		bearerAuth = true
+	}
+
 	email, err := FormatEmail(requestData["email"])
 	if err != nil {
 		respondError(w, r, 400, "email address is not valid")
@@ -156,13 +320,21 @@ func send(w http.ResponseWriter, r *http.Request) {
 	}
 	requestData["email"] = email
 
-	err = dispatch.Send(requestData)
-	if err != nil {
+	var messageID string
+	if certAuth || bearerAuth {
+		messageID, err = dispatch.SendTarget(target, requestData)
+	} else {
+		messageID, err = dispatch.Send(requestData)
+	}
+	if err == ErrDeliveryFailed {
+		respondError(w, r, 502, "%v", err)
+		return
+	} else if err != nil {
 		respondError(w, r, 400, "%v", err)
 		return
 	}
 
-	respondSuccess(w, r)
+	respondSuccess(w, r, messageID)
 }
 
 func getHeaderValues(h http.Header) DispatchRequest {
@@ -200,18 +372,19 @@ func respondError(w http.ResponseWriter, r *http.Request, code int, message stri
 	w.Write([]byte(msg))
 }
 
-func respondSuccess(w http.ResponseWriter, r *http.Request) {
-	var msg string
+func respondSuccess(w http.ResponseWriter, r *http.Request, messageID string) {
+	var msg []byte
+	w.Header().Set("X-Dispatch-Message-Id", messageID)
 	if r.Header.Get("Content-Type") == "application/json" {
-		msg = "{\"status\": \"success\"}"
+		msg, _ = json.Marshal(map[string]string{"status": "success", "message_id": messageID})
 		w.Header().Add("Content-Type", "application/json")
 	} else { // default is text response
-		msg = "200 success"
+		msg = []byte("200 success")
 		w.Header().Add("Content-Type", "text/plain")
 	}
 
 	w.WriteHeader(200)
-	w.Write([]byte(msg))
+	w.Write(msg)
 }
 
 func splitIPList(ipList string) []string {
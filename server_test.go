@@ -2,7 +2,12 @@ package main
 
 import "testing"
 
+import "encoding/json"
+import "strings"
+import "time"
 import "net/http"
+import "net/http/httptest"
+import "github.com/golang-jwt/jwt/v5"
 import "github.com/stretchr/testify/assert"
 
 func TestGetHeaders(t *testing.T) {
@@ -22,3 +27,54 @@ func TestGetHeaders(t *testing.T) {
 
 	assert.EqualValues(t, expected, result)
 }
+
+func TestRespondSuccess(t *testing.T) {
+	r := httptest.NewRequest("POST", "/send", nil)
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	respondSuccess(w, r, "<1.a@my-site.com>")
+
+	assert.Equal(t, "<1.a@my-site.com>", w.Header().Get("X-Dispatch-Message-Id"))
+	var body map[string]string
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, map[string]string{"status": "success", "message_id": "<1.a@my-site.com>"}, body)
+}
+
+func TestSendBearerClaims(t *testing.T) {
+	defer func(d *Dispatch) { dispatch = d }(dispatch)
+	dispatch = NewDispatch(t.TempDir(), SMTPSettings{})
+	validator, err := NewJWTValidator(JWTSettings{
+		Keys:   []JWTKeySettings{{Algorithm: "HS256", Secret: "secret"}},
+		Claims: []string{"email"},
+	})
+	assert.NoError(t, err)
+	dispatch.SetJWTValidator(validator)
+	target, err := loadTarget("example", []byte("to: [admin@my-site.com]\n"))
+	assert.NoError(t, err)
+	assert.NoError(t, dispatch.AddTarget(target))
+	transport := &testTransport{name: "test"}
+	target = dispatch.nameMap["example"]
+	target.transports = []Transport{transport}
+	dispatch.nameMap["example"] = target
+
+	post := func(email string) int {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+			"sub":   "example",
+			"email": email,
+			"exp":   time.Now().Add(time.Minute).Unix(),
+		})
+		raw, _ := token.SignedString([]byte("secret"))
+		r := httptest.NewRequest("POST", "/send", strings.NewReader(`{"email": "jo@anywhere.com"}`))
+		r.Header.Set("Authorization", "Bearer "+raw)
+		w := httptest.NewRecorder()
+		send(w, r)
+		return w.Code
+	}
+
+	// the email from the claims replaces the one sent, and is validated too
+	assert.Equal(t, 400, post("not an address"))
+	assert.Equal(t, 200, post("Sam <sam@anywhere.com>"))
+	if assert.Len(t, transport.messages, 1) {
+		assert.Equal(t, `"Sam" <sam@anywhere.com>`, transport.messages[0].Fields["email"])
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// slack allows at most 10 fields in a single section block
+	slackMaxSectionFields = 10
+	// slackMaxHeader is the most characters of a header block
+	slackMaxHeader = 150
+	// slackMaxSectionText is the most characters of a section text
+	slackMaxSectionText = 3000
+	// slackMaxFieldText is the most characters of a section field
+	slackMaxFieldText = 2000
+	// slackMaxBlocks is the most blocks in a single message
+	slackMaxBlocks = 50
+)
+
+// SlackTransport posts messages to a Slack or Mattermost incoming webhook
+type SlackTransport struct {
+	name     string
+	settings slackSettings
+	client   *http.Client
+}
+
+type slackSettings struct {
+	URL       string        `yaml:"url"`
+	Channel   string        `yaml:"channel"`
+	Username  string        `yaml:"username"`
+	IconEmoji string        `yaml:"icon-emoji"`
+	Timeout   time.Duration `yaml:"timeout"`
+}
+
+type slackMessage struct {
+	Text      string       `json:"text"`
+	Blocks    []slackBlock `json:"blocks,omitempty"`
+	Channel   string       `json:"channel,omitempty"`
+	Username  string       `json:"username,omitempty"`
+	IconEmoji string       `json:"icon_emoji,omitempty"`
+}
+
+type slackBlock struct {
+	Type   string      `json:"type"`
+	Text   *slackText  `json:"text,omitempty"`
+	Fields []slackText `json:"fields,omitempty"`
+}
+
+type slackText struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+func newSlackTransport(d *Dispatch, target DispatchTarget, config OutputConfig) (Transport, error) {
+	t := &SlackTransport{name: config.Name}
+	if err := config.decode(&t.settings); err != nil {
+		return nil, err
+	}
+	// the webhook url is all it takes to post, so treat it as a secret
+	if err := resolveSecrets(&t.settings.URL); err != nil {
+		return nil, err
+	}
+	if len(t.settings.URL) == 0 {
+		return nil, errors.New("a webhook url is required")
+	}
+	if t.settings.Timeout == 0 {
+		t.settings.Timeout = 10 * time.Second
+	}
+	t.client = &http.Client{Timeout: t.settings.Timeout}
+	return t, nil
+}
+
+// Name returns the output name
+func (t *SlackTransport) Name() string {
+	return t.name
+}
+
+// Send posts the message to the webhook
+func (t *SlackTransport) Send(ctx context.Context, message Message) error {
+	payload := formatSlackMessage(message)
+	payload.Channel = t.settings.Channel
+	payload.Username = t.settings.Username
+	payload.IconEmoji = t.settings.IconEmoji
+	return doJSON(ctx, t.client, "POST", t.settings.URL, nil, payload, nil)
+}
+
+// Check makes sure the webhook host can be reached, without posting a message
+func (t *SlackTransport) Check(ctx context.Context) error {
+	return checkURL(ctx, t.client, t.settings.URL)
+}
+
+// formatSlackMessage renders a message as Block Kit blocks. The text is also
+// filled in for notifications and for Mattermost, which ignores blocks.
+func formatSlackMessage(message Message) slackMessage {
+	var blocks []slackBlock
+	var text strings.Builder
+
+	if len(message.Subject) > 0 {
+		blocks = append(blocks, slackBlock{
+			Type: "header",
+			Text: &slackText{"plain_text", truncateRunes(message.Subject, slackMaxHeader)},
+		})
+		fmt.Fprintf(&text, "*%s*\n", slackEscape(message.Subject))
+	}
+
+	var fields []slackText
+	for _, key := range sortedFieldKeys(message.Fields) {
+		value := slackEscape(message.Fields[key])
+		if key == "email" {
+			value = slackMailto(message.Fields[key])
+		}
+		line := fmt.Sprintf("*%s:* %s", slackEscape(strings.Title(key)), value)
+		fields = append(fields, slackText{"mrkdwn", truncateRunes(line, slackMaxFieldText)})
+		text.WriteString(line + "\n")
+	}
+	for len(fields) > 0 {
+		n := len(fields)
+		if n > slackMaxSectionFields {
+			n = slackMaxSectionFields
+		}
+		blocks = append(blocks, slackBlock{Type: "section", Fields: fields[:n]})
+		fields = fields[n:]
+	}
+
+	if msg := message.Fields["message"]; len(msg) > 0 {
+		quoted := slackQuote(msg)
+		// long messages are split over several sections, anything past the
+		// block limit is only in the text
+		for _, chunk := range slackChunks(quoted, slackMaxSectionText) {
+			if len(blocks) >= slackMaxBlocks {
+				break
+			}
+			blocks = append(blocks, slackBlock{
+				Type: "section",
+				Text: &slackText{"mrkdwn", chunk},
+			})
+		}
+		text.WriteString(quoted)
+	}
+
+	return slackMessage{Text: strings.TrimSpace(text.String()), Blocks: blocks}
+}
+
+// sortedFieldKeys returns the field names to list, leaving out the message
+func sortedFieldKeys(fields map[string]string) []string {
+	var keys []string
+	for key, value := range fields {
+		if key == "message" || len(value) == 0 {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func slackEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
+
+func slackMailto(address string) string {
+	email, err := mail.ParseAddress(address)
+	if err != nil {
+		return slackEscape(address)
+	}
+	return fmt.Sprintf("<mailto:%s|%s>", email.Address, slackEscape(address))
+}
+
+func slackQuote(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	for i, line := range lines {
+		lines[i] = "> " + slackEscape(line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// slackChunks splits quoted text into chunks of at most limit characters,
+// breaking between lines when it can
+func slackChunks(quoted string, limit int) []string {
+	var chunks []string
+	var chunk []rune
+	for _, line := range strings.Split(quoted, "\n") {
+		l := []rune(line)
+		for len(l) > limit {
+			// a line that does not fit on its own continues in the next quote
+			if len(chunk) > 0 {
+				chunks = append(chunks, string(chunk))
+				chunk = nil
+			}
+			chunks = append(chunks, string(l[:limit]))
+			l = append([]rune("> "), l[limit:]...)
+		}
+		if len(chunk) > 0 && len(chunk)+1+len(l) > limit {
+			chunks = append(chunks, string(chunk))
+			chunk = nil
+		}
+		if len(chunk) > 0 {
+			chunk = append(chunk, '\n')
+		}
+		chunk = append(chunk, l...)
+	}
+	if len(chunk) > 0 {
+		chunks = append(chunks, string(chunk))
+	}
+	return chunks
+}
+
+// truncateRunes cuts s to at most limit characters
+func truncateRunes(s string, limit int) string {
+	if runes := []rune(s); len(runes) > limit {
+		return string(runes[:limit])
+	}
+	return s
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSlackTransport(t *testing.T) {
+	var received slackMessage
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&received)
+		w.Write([]byte("ok"))
+	}))
+	defer stub.Close()
+
+	transport, err := newSlackTransport(nil, DispatchTarget{},
+		OutputConfig{Name: "support", Type: "slack", Options: map[string]interface{}{"url": stub.URL}})
+	assert.NoError(t, err)
+
+	err = transport.Send(context.Background(), Message{
+		Subject: "[dispatch] example",
+		Fields: map[string]string{
+			"name":    "Anon <script>",
+			"email":   "anon@my-site.com",
+			"message": "Hello!\nSecond line",
+		},
+	})
+	assert.NoError(t, err)
+
+	assert.Len(t, received.Blocks, 3)
+	assert.Equal(t, "header", received.Blocks[0].Type)
+	assert.Equal(t, []slackText{
+		{"mrkdwn", "*Email:* <mailto:anon@my-site.com|anon@my-site.com>"},
+		{"mrkdwn", "*Name:* Anon &lt;script&gt;"},
+	}, received.Blocks[1].Fields)
+	assert.Equal(t, "> Hello!\n> Second line", received.Blocks[2].Text.Text)
+	assert.Contains(t, received.Text, "> Hello!")
+}
+
+func TestFormatSlackMessageLimits(t *testing.T) {
+	long := strings.Repeat("word ", 700) + "\n" + strings.Repeat("x", 4000)
+	payload := formatSlackMessage(Message{
+		Subject: strings.Repeat("s", 200),
+		Fields:  map[string]string{"message": long},
+	})
+
+	assert.Len(t, []rune(payload.Blocks[0].Text.Text), slackMaxHeader)
+	// both lines are too long for a section and continue in the next one
+	assert.Len(t, payload.Blocks, 5)
+	xs := 0
+	for _, block := range payload.Blocks[1:] {
+		assert.Equal(t, "section", block.Type)
+		assert.LessOrEqual(t, len([]rune(block.Text.Text)), slackMaxSectionText)
+		assert.True(t, strings.HasPrefix(block.Text.Text, "> "))
+		xs += strings.Count(block.Text.Text, "x")
+	}
+	assert.Equal(t, 4000, xs)
+
+	assert.Equal(t, []string{"> a\n> b"}, slackChunks("> a\n> b", 10))
+	assert.Equal(t, []string{"> a", "> b"}, slackChunks("> a\n> b", 4))
+	assert.Contains(t, payload.Text, strings.Repeat("x", 4000))
+
+	// long field values are cut short in the blocks, but not in the text
+	payload = formatSlackMessage(Message{Fields: map[string]string{"company": strings.Repeat("c", 2500)}})
+	if assert.Len(t, payload.Blocks, 1) {
+		assert.Len(t, []rune(payload.Blocks[0].Fields[0].Text), slackMaxFieldText)
+	}
+	assert.Contains(t, payload.Text, strings.Repeat("c", 2500))
+}
+
+func TestSlackTransportError(t *testing.T) {
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(404)
+		w.Write([]byte("no_service"))
+	}))
+	defer stub.Close()
+
+	transport, err := newSlackTransport(nil, DispatchTarget{},
+		OutputConfig{Name: "support", Type: "slack", Options: map[string]interface{}{"url": stub.URL}})
+	assert.NoError(t, err)
+
+	err = transport.Send(context.Background(), Message{Fields: map[string]string{"message": "hi"}})
+	assert.EqualError(t, err, "server responded 404 no_service")
+
+	_, err = newSlackTransport(nil, DispatchTarget{}, OutputConfig{Name: "support", Type: "slack"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// smtpAuthMechanisms are the supported values of the auth setting, an empty
+// value picks the best mechanism the server offers
+var smtpAuthMechanisms = []string{"none", "plain", "login", "cram-md5", "xoauth2"}
+
+// OAuth2Settings defines how XOAUTH2 access tokens are obtained
+type OAuth2Settings struct {
+	TokenURL     string   `mapstructure:"token_url"`
+	ClientID     string   `mapstructure:"client_id"`
+	ClientSecret string   `mapstructure:"client_secret"`
+	RefreshToken string   `mapstructure:"refresh_token"`
+	Scopes       []string `mapstructure:"scopes"`
+}
+
+// checkSMTPAuth validates the auth settings of a relay
+func checkSMTPAuth(relay SMTPRelaySettings) error {
+	if len(relay.Auth) == 0 {
+		return nil
+	}
+	if !contains(smtpAuthMechanisms, relay.Auth) {
+		return fmt.Errorf("auth '%s' must be one of %s", relay.Auth, strings.Join(smtpAuthMechanisms, ", "))
+	}
+	if relay.Auth != "none" && len(relay.UserName) == 0 {
+		return fmt.Errorf("auth %s requires a username", relay.Auth)
+	}
+	if relay.Auth == "xoauth2" {
+		o := relay.OAuth2
+		if len(o.TokenURL) == 0 || len(o.ClientID) == 0 || len(o.RefreshToken) == 0 {
+			return errors.New("auth xoauth2 requires an oauth2 token_url, client_id and refresh_token")
+		}
+	}
+	return nil
+}
+
+// chooseSMTPAuth returns the auth for the configured mechanism. Without one,
+// the best mechanism the server offers is picked the same way gomail does.
+func chooseSMTPAuth(relay SMTPRelaySettings, mechanisms string, tokens *oauth2Tokens) (smtp.Auth, error) {
+	switch relay.Auth {
+	case "plain":
+		return smtp.PlainAuth("", relay.UserName, relay.Password, relay.Host), nil
+	case "login":
+		return &loginAuth{relay.UserName, relay.Password, relay.Host}, nil
+	case "cram-md5":
+		return smtp.CRAMMD5Auth(relay.UserName, relay.Password), nil
+	case "xoauth2":
+		token, err := tokens.Token()
+		if err != nil {
+			return nil, fmt.Errorf("could not get an oauth2 token: %v", err)
+		}
+		return &xoauth2Auth{relay.UserName, token, relay.Host}, nil
+	}
+
+	if strings.Contains(mechanisms, "CRAM-MD5") {
+		return smtp.CRAMMD5Auth(relay.UserName, relay.Password), nil
+	}
+	if strings.Contains(mechanisms, "LOGIN") && !strings.Contains(mechanisms, "PLAIN") {
+		return &loginAuth{relay.UserName, relay.Password, relay.Host}, nil
+	}
+	return smtp.PlainAuth("", relay.UserName, relay.Password, relay.Host), nil
+}
+
+// loginAuth implements the LOGIN authentication mechanism
+type loginAuth struct {
+	username string
+	password string
+	host     string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if err := checkAuthServer(server, a.host); err != nil {
+		return "", nil, err
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch strings.ToLower(strings.TrimSpace(string(fromServer))) {
+	case "username:":
+		return []byte(a.username), nil
+	case "password:":
+		return []byte(a.password), nil
+	}
+	return nil, fmt.Errorf("unexpected server challenge: %s", fromServer)
+}
+
+// xoauth2Auth implements the XOAUTH2 mechanism used by Google and Microsoft
+type xoauth2Auth struct {
+	username string
+	token    string
+	host     string
+}
+
+func (a *xoauth2Auth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if err := checkAuthServer(server, a.host); err != nil {
+		return "", nil, err
+	}
+	return "XOAUTH2", []byte("user=" + a.username + "\x01auth=Bearer " + a.token + "\x01\x01"), nil
+}
+
+func (a *xoauth2Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	// on failure the server sends a json error, an empty reply ends the
+	// exchange so the server returns its error code
+	if more {
+		return []byte{}, nil
+	}
+	return nil, nil
+}
+
+// checkAuthServer refuses to send credentials over a plain connection, the
+// same way the net/smtp PLAIN auth does
+func checkAuthServer(server *smtp.ServerInfo, host string) error {
+	if !server.TLS && !isLocalhost(server.Name) {
+		return errors.New("unencrypted connection")
+	}
+	if server.Name != host {
+		return errors.New("wrong host name")
+	}
+	return nil
+}
+
+func isLocalhost(name string) bool {
+	return name == "localhost" || name == "127.0.0.1" || name == "::1"
+}
+
+// oauth2Tokens gets access tokens with a refresh token and keeps them until
+// they are about to expire
+type oauth2Tokens struct {
+	settings OAuth2Settings
+	client   *http.Client
+
+	mutex  sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+type oauth2TokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+func newOAuth2Tokens(settings OAuth2Settings) *oauth2Tokens {
+	return &oauth2Tokens{
+		settings: settings,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Token returns a valid access token, refreshing it when needed
+func (t *oauth2Tokens) Token() (string, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	// leave a margin so the token does not expire in the middle of a login
+	if len(t.token) > 0 && time.Now().Add(time.Minute).Before(t.expiry) {
+		return t.token, nil
+	}
+
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {t.settings.RefreshToken},
+		"client_id":     {t.settings.ClientID},
+	}
+	if len(t.settings.ClientSecret) > 0 {
+		form.Set("client_secret", t.settings.ClientSecret)
+	}
+	if len(t.settings.Scopes) > 0 {
+		form.Set("scope", strings.Join(t.settings.Scopes, " "))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", t.settings.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return "", newHTTPError(resp)
+	}
+
+	var token oauth2TokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", err
+	}
+	if len(token.AccessToken) == 0 {
+		return "", errors.New("token endpoint did not return an access token")
+	}
+	t.token = token.AccessToken
+	t.expiry = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	if token.ExpiresIn == 0 {
+		// without an expiry, refresh the token every so often anyway
+		t.expiry = time.Now().Add(30 * time.Minute)
+	}
+	// some providers rotate the refresh token
+	if len(token.RefreshToken) > 0 {
+		t.settings.RefreshToken = token.RefreshToken
+	}
+	return t.token, nil
+}
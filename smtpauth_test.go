@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOAuth2Tokens(t *testing.T) {
+	requests := 0
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		r.ParseForm()
+		assert.Equal(t, "refresh_token", r.Form.Get("grant_type"))
+		assert.Equal(t, "refresh-1", r.Form.Get("refresh_token"))
+		assert.Equal(t, "https://outlook.office.com/SMTP.Send", r.Form.Get("scope"))
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token": "access-1", "expires_in": 3600, "token_type": "Bearer"}`))
+	}))
+	defer stub.Close()
+
+	tokens := newOAuth2Tokens(OAuth2Settings{
+		TokenURL:     stub.URL,
+		ClientID:     "dispatch",
+		RefreshToken: "refresh-1",
+		Scopes:       []string{"https://outlook.office.com/SMTP.Send"},
+	})
+	for i := 0; i < 2; i++ {
+		token, err := tokens.Token()
+		assert.NoError(t, err)
+		assert.Equal(t, "access-1", token)
+	}
+	assert.Equal(t, 1, requests)
+}
+
+func TestXOAUTH2Auth(t *testing.T) {
+	auth := &xoauth2Auth{"dispatch@my-site.com", "access-1", "smtp.office365.com"}
+	mechanism, response, err := auth.Start(&smtp.ServerInfo{Name: "smtp.office365.com", TLS: true})
+	assert.NoError(t, err)
+	assert.Equal(t, "XOAUTH2", mechanism)
+	assert.Equal(t, "user=dispatch@my-site.com\x01auth=Bearer access-1\x01\x01", string(response))
+
+	_, _, err = auth.Start(&smtp.ServerInfo{Name: "smtp.office365.com"})
+	assert.Error(t, err)
+}
+
+func TestRelayXOAUTH2(t *testing.T) {
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"access_token": "access-1", "expires_in": 3600}`))
+	}))
+	defer stub.Close()
+
+	server := newTestSMTPServer(t, "250 queued")
+	relay := server.relay("office", 0)
+	relay.UserName = "dispatch@my-site.com"
+	relay.Auth = "xoauth2"
+	relay.OAuth2 = OAuth2Settings{TokenURL: stub.URL, ClientID: "dispatch", RefreshToken: "refresh-1"}
+	relays := newRelays(SMTPSettings{Relays: []SMTPRelaySettings{relay}})
+
+	assert.NoError(t, relays.Send(context.Background(), newTestRelayMessage(), nil))
+	response := base64.StdEncoding.EncodeToString([]byte("user=dispatch@my-site.com\x01auth=Bearer access-1\x01\x01"))
+	assert.Equal(t, "AUTH XOAUTH2 "+response, server.auth)
+}
+
+func TestCheckSMTPAuth(t *testing.T) {
+	assert.NoError(t, checkSMTPAuth(SMTPRelaySettings{}))
+	assert.NoError(t, checkSMTPAuth(SMTPRelaySettings{Auth: "none"}))
+	assert.Error(t, checkSMTPAuth(SMTPRelaySettings{Auth: "digest-md5", UserName: "dispatch"}))
+	assert.Error(t, checkSMTPAuth(SMTPRelaySettings{Auth: "login"}))
+	assert.Error(t, checkSMTPAuth(SMTPRelaySettings{Auth: "xoauth2", UserName: "dispatch"}))
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// telegramMaxLength is the most UTF-16 code units telegram accepts in a message
+const telegramMaxLength = 4096
+
+// telegramMaxSubject keeps the subject from filling up the first message
+const telegramMaxSubject = 256
+
+// TelegramTransport sends messages through a Telegram bot
+type TelegramTransport struct {
+	name     string
+	settings telegramSettings
+	client   *http.Client
+}
+
+type telegramSettings struct {
+	BotToken       string        `yaml:"bot-token"`
+	ChatID         string        `yaml:"chat-id"`
+	ParseMode      string        `yaml:"parse-mode"`
+	APIURL         string        `yaml:"api-url"`
+	DisablePreview bool          `yaml:"disable-preview"`
+	Timeout        time.Duration `yaml:"timeout"`
+}
+
+type telegramMessage struct {
+	ChatID         string `json:"chat_id"`
+	Text           string `json:"text"`
+	ParseMode      string `json:"parse_mode,omitempty"`
+	DisablePreview bool   `json:"disable_web_page_preview,omitempty"`
+}
+
+func newTelegramTransport(d *Dispatch, target DispatchTarget, config OutputConfig) (Transport, error) {
+	t := &TelegramTransport{name: config.Name}
+	s := &t.settings
+	s.ParseMode = "MarkdownV2"
+	if err := config.decode(s); err != nil {
+		return nil, err
+	}
+	if err := resolveSecrets(&s.BotToken); err != nil {
+		return nil, err
+	}
+	if len(s.BotToken) == 0 || len(s.ChatID) == 0 {
+		return nil, errors.New("a bot-token and chat-id are required")
+	}
+	switch strings.ToLower(s.ParseMode) {
+	case "markdownv2":
+		s.ParseMode = "MarkdownV2"
+	case "html":
+		s.ParseMode = "HTML"
+	case "", "none":
+		s.ParseMode = ""
+	default:
+		return nil, fmt.Errorf("parse-mode '%s' must be MarkdownV2, HTML or none", s.ParseMode)
+	}
+	if len(s.APIURL) == 0 {
+		s.APIURL = "https://api.telegram.org"
+	}
+	s.APIURL = strings.TrimRight(s.APIURL, "/")
+	if s.Timeout == 0 {
+		s.Timeout = 10 * time.Second
+	}
+	t.client = &http.Client{Timeout: s.Timeout}
+	return t, nil
+}
+
+// Name returns the output name
+func (t *TelegramTransport) Name() string {
+	return t.name
+}
+
+// Send posts the message to the chat, split into several messages if needed
+func (t *TelegramTransport) Send(ctx context.Context, message Message) error {
+	for _, text := range formatTelegramMessage(message, t.settings.ParseMode) {
+		payload := telegramMessage{
+			ChatID:         t.settings.ChatID,
+			Text:           text,
+			ParseMode:      t.settings.ParseMode,
+			DisablePreview: t.settings.DisablePreview,
+		}
+		err := doJSON(ctx, t.client, "POST", t.endpoint("sendMessage"), nil, payload, nil)
+		if err != nil {
+			return hideURL(err)
+		}
+	}
+	return nil
+}
+
+// Check verifies the bot token
+func (t *TelegramTransport) Check(ctx context.Context) error {
+	return hideURL(doJSON(ctx, t.client, "POST", t.endpoint("getMe"), nil, struct{}{}, nil))
+}
+
+func (t *TelegramTransport) endpoint(method string) string {
+	return fmt.Sprintf("%s/bot%s/%s", t.settings.APIURL, t.settings.BotToken, method)
+}
+
+// hideURL removes the request url from an error, since it holds the bot token
+func hideURL(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return fmt.Errorf("%s: %v", urlErr.Op, urlErr.Err)
+	}
+	return err
+}
+
+// formatTelegramMessage escapes the message for the parse mode and splits it
+// into parts that fit in a telegram message
+func formatTelegramMessage(message Message, parseMode string) []string {
+	escape := func(s string) string { return s }
+	bold := func(s string) string { return s }
+	switch parseMode {
+	case "MarkdownV2":
+		escape = telegramEscapeMarkdown
+		bold = func(s string) string { return "*" + s + "*" }
+	case "HTML":
+		escape = html.EscapeString
+		bold = func(s string) string { return "<b>" + s + "</b>" }
+	}
+
+	var units []string
+	if subject := []rune(message.Subject); len(subject) > 0 {
+		if len(subject) > telegramMaxSubject {
+			subject = subject[:telegramMaxSubject]
+		}
+		units = append(units, bold(escape(string(subject))), "\n", "\n")
+	}
+	for _, r := range strings.TrimSpace(message.TextMessage) {
+		units = append(units, escape(string(r)))
+	}
+	return splitTelegramUnits(units, telegramMaxLength)
+}
+
+// splitTelegramUnits joins escaped units into parts no longer than limit,
+// breaking on a newline when possible so escape sequences are never split
+func splitTelegramUnits(units []string, limit int) []string {
+	var parts []string
+	var current []string
+	length := 0
+	lastNewline := -1
+
+	for _, unit := range units {
+		unitLength := len(utf16.Encode([]rune(unit)))
+		if length+unitLength > limit && len(current) > 0 {
+			cut := len(current)
+			if lastNewline > 0 {
+				cut = lastNewline + 1
+			}
+			parts = append(parts, strings.TrimSpace(strings.Join(current[:cut], "")))
+			current = append([]string{}, current[cut:]...)
+			length = 0
+			lastNewline = -1
+			for i, u := range current {
+				length += len(utf16.Encode([]rune(u)))
+				if u == "\n" {
+					lastNewline = i
+				}
+			}
+		}
+		if unit == "\n" {
+			lastNewline = len(current)
+		}
+		current = append(current, unit)
+		length += unitLength
+	}
+	if len(current) > 0 {
+		parts = append(parts, strings.TrimSpace(strings.Join(current, "")))
+	}
+	return parts
+}
+
+func telegramEscapeMarkdown(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune("_*[]()~`>#+-=|{}.!\\", r) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTelegramTransport(t *testing.T) {
+	var path string
+	var received []telegramMessage
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		var msg telegramMessage
+		json.NewDecoder(r.Body).Decode(&msg)
+		received = append(received, msg)
+		w.Write([]byte(`{"ok": true}`))
+	}))
+	defer stub.Close()
+
+	transport, err := newTelegramTransport(nil, DispatchTarget{}, OutputConfig{Name: "oncall", Type: "telegram",
+		Options: map[string]interface{}{
+			"bot-token": "123:abc",
+			"chat-id":   "-100200",
+			"api-url":   stub.URL,
+		}})
+	assert.NoError(t, err)
+
+	err = transport.Send(context.Background(), Message{
+		Subject:     "[dispatch] example",
+		TextMessage: "Hello (world)!",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "/bot123:abc/sendMessage", path)
+	assert.Equal(t, []telegramMessage{{
+		ChatID:    "-100200",
+		Text:      "*\\[dispatch\\] example*\n\nHello \\(world\\)\\!",
+		ParseMode: "MarkdownV2",
+	}}, received)
+}
+
+func TestFormatTelegramMessageSplit(t *testing.T) {
+	line := strings.Repeat("a.", 1000) + "\n"
+	parts := formatTelegramMessage(Message{TextMessage: strings.Repeat(line, 3)}, "MarkdownV2")
+	assert.Len(t, parts, 3)
+	for _, part := range parts {
+		assert.Equal(t, strings.Repeat("a\\.", 1000), part)
+	}
+
+	parts = formatTelegramMessage(Message{TextMessage: strings.Repeat("<", 5000)}, "HTML")
+	assert.Len(t, parts, 5)
+	for _, part := range parts {
+		assert.LessOrEqual(t, len(part), telegramMaxLength)
+		assert.False(t, strings.HasSuffix(part, "&lt"))
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	// embed the time zone database for systems that do not have one
+	_ "time/tzdata"
+)
+
+const defaultTimeFormat = "Jan 02, 2006 15:04:05 MST"
+
+// TimeSettings defines how the timestamp field is formatted
+type TimeSettings struct {
+	// Zone is an IANA time zone name like Europe/Berlin, or Local
+	Zone string `yaml:"zone" mapstructure:"zone"`
+	// Format is a Go time layout
+	Format string `yaml:"format" mapstructure:"format"`
+	// Locale picks the language of the month and day names
+	Locale string `yaml:"locale" mapstructure:"locale"`
+
+	location *time.Location
+	names    *timeNames
+}
+
+// prepare loads the time zone and locale of the settings
+func (s *TimeSettings) prepare() error {
+	if len(s.Zone) > 0 {
+		location, err := time.LoadLocation(s.Zone)
+		if err != nil {
+			return fmt.Errorf("zone: %v", err)
+		}
+		s.location = location
+	}
+	if len(s.Locale) > 0 {
+		language := strings.ToLower(s.Locale)
+		if i := strings.IndexAny(language, "-_"); i > 0 {
+			language = language[:i]
+		}
+		names, found := timeLocales[language]
+		if !found {
+			return fmt.Errorf("locale '%s' is not supported", s.Locale)
+		}
+		s.names = names
+	}
+	return nil
+}
+
+// override returns the settings with any values set in other replacing them
+func (s TimeSettings) override(other TimeSettings) TimeSettings {
+	if other.location != nil {
+		s.Zone, s.location = other.Zone, other.location
+	}
+	if len(other.Format) > 0 {
+		s.Format = other.Format
+	}
+	if other.names != nil {
+		s.Locale, s.names = other.Locale, other.names
+	}
+	return s
+}
+
+// formatTime formats t in the time zone, layout and language of the settings
+func (s TimeSettings) formatTime(t time.Time) string {
+	if s.location != nil {
+		t = t.In(s.location)
+	}
+	layout := s.Format
+	if len(layout) == 0 {
+		layout = defaultTimeFormat
+	}
+	if s.names == nil {
+		return t.Format(layout)
+	}
+	return s.names.format(t, layout)
+}
+
+// isoTime formats t as RFC 3339 in the time zone of the settings
+func (s TimeSettings) isoTime(t time.Time) string {
+	if s.location != nil {
+		t = t.In(s.location)
+	}
+	return t.Format(time.RFC3339)
+}
+
+// timeNames are the month and day names of a language
+type timeNames struct {
+	months      [12]string
+	shortMonths [12]string
+	days        [7]string
+	shortDays   [7]string
+}
+
+// format formats t, writing the month and day names of the layout in the
+// language instead of English
+func (n *timeNames) format(t time.Time, layout string) string {
+	var out strings.Builder
+	for len(layout) > 0 {
+		i, token := nextNameToken(layout)
+		if i < 0 {
+			out.WriteString(t.Format(layout))
+			break
+		}
+		if i > 0 {
+			out.WriteString(t.Format(layout[:i]))
+		}
+		switch token {
+		case "January":
+			out.WriteString(n.months[t.Month()-1])
+		case "Jan":
+			out.WriteString(n.shortMonths[t.Month()-1])
+		case "Monday":
+			out.WriteString(n.days[t.Weekday()])
+		case "Mon":
+			out.WriteString(n.shortDays[t.Weekday()])
+		}
+		layout = layout[i+len(token):]
+	}
+	return out.String()
+}
+
+// nextNameToken finds the first month or day name in a layout, the same way
+// the time package reads them
+func nextNameToken(layout string) (int, string) {
+	for i := 0; i < len(layout); i++ {
+		rest := layout[i:]
+		switch {
+		case strings.HasPrefix(rest, "January"):
+			return i, "January"
+		case strings.HasPrefix(rest, "Jan"):
+			return i, "Jan"
+		case strings.HasPrefix(rest, "Monday"):
+			return i, "Monday"
+		case strings.HasPrefix(rest, "Mon"):
+			return i, "Mon"
+		}
+	}
+	return -1, ""
+}
+
+var timeLocales = map[string]*timeNames{
+	"en": {
+		months:      [12]string{"January", "February", "March", "April", "May", "June", "July", "August", "September", "October", "November", "December"},
+		shortMonths: [12]string{"Jan", "Feb", "Mar", "Apr", "May", "Jun", "Jul", "Aug", "Sep", "Oct", "Nov", "Dec"},
+		days:        [7]string{"Sunday", "Monday", "Tuesday", "Wednesday", "Thursday", "Friday", "Saturday"},
+		shortDays:   [7]string{"Sun", "Mon", "Tue", "Wed", "Thu", "Fri", "Sat"},
+	},
+	"da": {
+		months:      [12]string{"januar", "februar", "marts", "april", "maj", "juni", "juli", "august", "september", "oktober", "november", "december"},
+		shortMonths: [12]string{"jan", "feb", "mar", "apr", "maj", "jun", "jul", "aug", "sep", "okt", "nov", "dec"},
+		days:        [7]string{"søndag", "mandag", "tirsdag", "onsdag", "torsdag", "fredag", "lørdag"},
+		shortDays:   [7]string{"søn", "man", "tir", "ons", "tor", "fre", "lør"},
+	},
+	"de": {
+		months:      [12]string{"Januar", "Februar", "März", "April", "Mai", "Juni", "Juli", "August", "September", "Oktober", "November", "Dezember"},
+		shortMonths: [12]string{"Jan", "Feb", "Mär", "Apr", "Mai", "Jun", "Jul", "Aug", "Sep", "Okt", "Nov", "Dez"},
+		days:        [7]string{"Sonntag", "Montag", "Dienstag", "Mittwoch", "Donnerstag", "Freitag", "Samstag"},
+		shortDays:   [7]string{"So", "Mo", "Di", "Mi", "Do", "Fr", "Sa"},
+	},
+	"es": {
+		months:      [12]string{"enero", "febrero", "marzo", "abril", "mayo", "junio", "julio", "agosto", "septiembre", "octubre", "noviembre", "diciembre"},
+		shortMonths: [12]string{"ene", "feb", "mar", "abr", "may", "jun", "jul", "ago", "sep", "oct", "nov", "dic"},
+		days:        [7]string{"domingo", "lunes", "martes", "miércoles", "jueves", "viernes", "sábado"},
+		shortDays:   [7]string{"dom", "lun", "mar", "mié", "jue", "vie", "sáb"},
+	},
+	"fr": {
+		months:      [12]string{"janvier", "février", "mars", "avril", "mai", "juin", "juillet", "août", "septembre", "octobre", "novembre", "décembre"},
+		shortMonths: [12]string{"janv.", "févr.", "mars", "avr.", "mai", "juin", "juil.", "août", "sept.", "oct.", "nov.", "déc."},
+		days:        [7]string{"dimanche", "lundi", "mardi", "mercredi", "jeudi", "vendredi", "samedi"},
+		shortDays:   [7]string{"dim.", "lun.", "mar.", "mer.", "jeu.", "ven.", "sam."},
+	},
+	"it": {
+		months:      [12]string{"gennaio", "febbraio", "marzo", "aprile", "maggio", "giugno", "luglio", "agosto", "settembre", "ottobre", "novembre", "dicembre"},
+		shortMonths: [12]string{"gen", "feb", "mar", "apr", "mag", "giu", "lug", "ago", "set", "ott", "nov", "dic"},
+		days:        [7]string{"domenica", "lunedì", "martedì", "mercoledì", "giovedì", "venerdì", "sabato"},
+		shortDays:   [7]string{"dom", "lun", "mar", "mer", "gio", "ven", "sab"},
+	},
+	"nb": {
+		months:      [12]string{"januar", "februar", "mars", "april", "mai", "juni", "juli", "august", "september", "oktober", "november", "desember"},
+		shortMonths: [12]string{"jan", "feb", "mar", "apr", "mai", "jun", "jul", "aug", "sep", "okt", "nov", "des"},
+		days:        [7]string{"søndag", "mandag", "tirsdag", "onsdag", "torsdag", "fredag", "lørdag"},
+		shortDays:   [7]string{"søn", "man", "tir", "ons", "tor", "fre", "lør"},
+	},
+	"nl": {
+		months:      [12]string{"januari", "februari", "maart", "april", "mei", "juni", "juli", "augustus", "september", "oktober", "november", "december"},
+		shortMonths: [12]string{"jan", "feb", "mrt", "apr", "mei", "jun", "jul", "aug", "sep", "okt", "nov", "dec"},
+		days:        [7]string{"zondag", "maandag", "dinsdag", "woensdag", "donderdag", "vrijdag", "zaterdag"},
+		shortDays:   [7]string{"zo", "ma", "di", "wo", "do", "vr", "za"},
+	},
+	"pt": {
+		months:      [12]string{"janeiro", "fevereiro", "março", "abril", "maio", "junho", "julho", "agosto", "setembro", "outubro", "novembro", "dezembro"},
+		shortMonths: [12]string{"jan", "fev", "mar", "abr", "mai", "jun", "jul", "ago", "set", "out", "nov", "dez"},
+		days:        [7]string{"domingo", "segunda-feira", "terça-feira", "quarta-feira", "quinta-feira", "sexta-feira", "sábado"},
+		shortDays:   [7]string{"dom", "seg", "ter", "qua", "qui", "sex", "sáb"},
+	},
+	"sv": {
+		months:      [12]string{"januari", "februari", "mars", "april", "maj", "juni", "juli", "augusti", "september", "oktober", "november", "december"},
+		shortMonths: [12]string{"jan", "feb", "mar", "apr", "maj", "jun", "jul", "aug", "sep", "okt", "nov", "dec"},
+		days:        [7]string{"söndag", "måndag", "tisdag", "onsdag", "torsdag", "fredag", "lördag"},
+		shortDays:   [7]string{"sön", "mån", "tis", "ons", "tor", "fre", "lör"},
+	},
+}
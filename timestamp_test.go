@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormatTime(t *testing.T) {
+	received := time.Date(2021, time.March, 7, 18, 30, 5, 0, time.UTC)
+
+	s := TimeSettings{}
+	assert.NoError(t, s.prepare())
+	assert.Equal(t, "Mar 07, 2021 18:30:05 UTC", s.formatTime(received))
+
+	s = TimeSettings{Zone: "Europe/Berlin", Format: "Monday, 2. January 2006 15:04 MST (Mon Jan)", Locale: "de_DE"}
+	assert.NoError(t, s.prepare())
+	assert.Equal(t, "Sonntag, 7. März 2021 19:30 CET (So Mär)", s.formatTime(received))
+	assert.Equal(t, "2021-03-07T19:30:05+01:00", s.isoTime(received))
+
+	s = TimeSettings{Locale: "fr"}
+	assert.NoError(t, s.prepare())
+	assert.Equal(t, "mars 07, 2021 18:30:05 UTC", s.formatTime(received))
+
+	assert.Error(t, (&TimeSettings{Zone: "Nowhere/Special"}).prepare())
+	assert.Error(t, (&TimeSettings{Locale: "xx"}).prepare())
+}
+
+func TestTargetTime(t *testing.T) {
+	target, err := loadTarget("example.yml", []byte(`
+name: example
+to: [admin@my-site.com]
+time:
+  zone: America/New_York
+templates:
+  text: "{{ .timestamp }} {{ .timestamp_iso }}"
+`))
+	assert.NoError(t, err)
+
+	transport := &testTransport{name: "test"}
+	target.transports = []Transport{transport}
+	d := NewDispatch(t.TempDir(), SMTPSettings{})
+	global := TimeSettings{Zone: "Europe/Berlin", Format: "02 Jan 2006 15:04", Locale: "nl"}
+	assert.NoError(t, global.prepare())
+	d.SetTimeSettings(global)
+
+	_, err = d.SendTarget(target, DispatchRequest{"timestamp_iso": "2021-03-07T18:30:05.123Z"})
+	assert.NoError(t, err)
+	assert.Equal(t, "07 mrt 2021 13:30 2021-03-07T13:30:05-05:00", transport.messages[0].TextMessage)
+
+	_, err = loadTarget("example.yml", []byte(`time: {zone: Nowhere/Special}`))
+	assert.Error(t, err)
+}
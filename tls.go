@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+)
+
+// TLSSettings defines the webserver TLS settings
+type TLSSettings struct {
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string
+	RedirectPort int
+}
+
+// Enabled returns true if the webserver should serve HTTPS
+func (t TLSSettings) Enabled() bool {
+	return len(t.CertFile) > 0 || len(t.KeyFile) > 0
+}
+
+func newTLSConfig(settings TLSSettings) (*tls.Config, *certReloader, error) {
+	if len(settings.CertFile) == 0 || len(settings.KeyFile) == 0 {
+		return nil, nil, errors.New("both a tls cert and key are required")
+	}
+
+	reloader, err := newCertReloader(settings.CertFile, settings.KeyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     []string{"h2", "http/1.1"},
+		GetCertificate: reloader.GetCertificate,
+	}
+
+	if len(settings.ClientCAFile) > 0 {
+		data, err := ioutil.ReadFile(settings.ClientCAFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, nil, fmt.Errorf("no certificates found in %s", settings.ClientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, reloader, nil
+}
+
+// certReloader serves the current certificate and reloads it from disk when
+// the files change or a SIGHUP is received. Connections that are already
+// established keep the certificate they were opened with.
+type certReloader struct {
+	sync.RWMutex
+	certFile string
+	keyFile  string
+	cert     *tls.Certificate
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.Lock()
+	c.cert = &cert
+	c.Unlock()
+	return nil
+}
+
+// GetCertificate returns the current certificate for a TLS handshake
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.RLock()
+	defer c.RUnlock()
+	return c.cert, nil
+}
+
+// Watch reloads the certificate whenever it changes on disk or on SIGHUP
+func (c *certReloader) Watch() {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+
+	// watch the directories so replaced or re-linked files are picked up
+	var events chan fsnotify.Event
+	var watchErrors chan error
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Warnf("tls: cannot watch certificate files: %v", err)
+	} else {
+		events = watcher.Events
+		watchErrors = watcher.Errors
+		for _, dir := range []string{filepath.Dir(c.certFile), filepath.Dir(c.keyFile)} {
+			if err := watcher.Add(dir); err != nil {
+				log.Warnf("tls: cannot watch %s: %v", dir, err)
+			}
+		}
+	}
+
+	for {
+		select {
+		case <-sighup:
+			log.Infof("tls: received SIGHUP, reloading certificate")
+		case event, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			if event.Op == fsnotify.Chmod || !c.isCertEvent(event) {
+				continue
+			}
+			log.Debugf("tls: %s", event)
+		case err, ok := <-watchErrors:
+			if !ok {
+				watchErrors = nil
+				continue
+			}
+			// the watcher blocks until its errors are read
+			log.Warnf("tls: error watching certificate files: %v", err)
+			continue
+		}
+		if err := c.reload(); err != nil {
+			log.Errorf("tls: could not reload certificate, keeping the current one: %v", err)
+			continue
+		}
+		log.Infof("tls: loaded certificate %s", c.certFile)
+	}
+}
+
+func (c *certReloader) isCertEvent(event fsnotify.Event) bool {
+	name := filepath.Base(event.Name)
+	// kubernetes secrets are swapped through a "..data" symlink
+	return name == filepath.Base(c.certFile) || name == filepath.Base(c.keyFile) ||
+		strings.HasPrefix(name, "..")
+}
+
+// redirectHandler sends every request to the same URL over HTTPS
+func redirectHandler(httpsPort int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if httpsPort != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(httpsPort))
+		}
+		target := "https://" + host + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+	})
+}
+
+// getClientCert returns the verified client certificate, if any
+func getClientCert(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
+
+// getCertNames returns the subject CN and all SANs of a certificate
+func getCertNames(cert *x509.Certificate) []string {
+	var names []string
+	if len(cert.Subject.CommonName) > 0 {
+		names = append(names, cert.Subject.CommonName)
+	}
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	return names
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthenticateCert(t *testing.T) {
+	d := NewDispatch(t.TempDir(), SMTPSettings{})
+	d.AddTarget(DispatchTarget{Name: "alerts", ClientNames: []string{"alerts.internal"},
+		To: []string{"oncall@my-site.com"}})
+
+	cert := &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "monitor"},
+		DNSNames: []string{"alerts.internal"},
+	}
+	assert.Equal(t, []string{"monitor", "alerts.internal"}, getCertNames(cert))
+
+	target, found := d.AuthenticateCert(cert)
+	assert.True(t, found)
+	assert.Equal(t, "alerts", target.Name)
+
+	_, found = d.AuthenticateCert(&x509.Certificate{Subject: pkix.Name{CommonName: "other"}})
+	assert.False(t, found)
+}
+
+func TestRedirectHandler(t *testing.T) {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "http://my-site.com:8080/send?x=1", nil)
+	redirectHandler(8443).ServeHTTP(w, r)
+	assert.Equal(t, 301, w.Code)
+	assert.Equal(t, "https://my-site.com:8443/send?x=1", w.Header().Get("Location"))
+
+	w = httptest.NewRecorder()
+	redirectHandler(443).ServeHTTP(w, r)
+	assert.Equal(t, "https://my-site.com/send?x=1", w.Header().Get("Location"))
+}
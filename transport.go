@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Transport delivers a message to a single destination
+type Transport interface {
+	// Name returns the name of the output the transport was created for
+	Name() string
+	// Send delivers the message
+	Send(ctx context.Context, message Message) error
+	// Check verifies the destination can be reached
+	Check(ctx context.Context) error
+}
+
+// OutputConfig defines a named output on a target. Any keys besides the name
+// and type are options for that type of transport.
+type OutputConfig struct {
+	Name    string                 `yaml:"name"`
+	Type    string                 `yaml:"type"`
+	Options map[string]interface{} `yaml:",inline"`
+}
+
+// decode unmarshals the output options into a transport specific struct
+func (c OutputConfig) decode(v interface{}) error {
+	data, err := yaml.Marshal(c.Options)
+	if err != nil {
+		return err
+	}
+	return yaml.UnmarshalStrict(data, v)
+}
+
+// transportFactory creates a transport for a target output
+type transportFactory func(d *Dispatch, target DispatchTarget, config OutputConfig) (Transport, error)
+
+var transportTypes = map[string]transportFactory{
+	"smtp":       newSMTPTransport,
+	"slack":      newSlackTransport,
+	"mattermost": newSlackTransport,
+	"webhook":    newWebhookTransport,
+	"matrix":     newMatrixTransport,
+	"telegram":   newTelegramTransport,
+	"ntfy":       newNtfyTransport,
+	"gotify":     newGotifyTransport,
+	"sendmail":   newSendmailTransport,
+	"pipe":       newSendmailTransport,
+	"maildir":    newMaildirTransport,
+	"mbox":       newMboxTransport,
+}
+
+// defaultOutputs is used by targets that do not list any outputs
+var defaultOutputs = []OutputConfig{{Name: "smtp", Type: "smtp"}}
+
+// emailOutputTypes are the output types that send email to the recipients
+var emailOutputTypes = []string{"smtp", "sendmail"}
+
+// emailOutputs returns the names of the target outputs that send email
+func (t DispatchTarget) emailOutputs() []string {
+	outputs := t.Outputs
+	if len(outputs) == 0 {
+		outputs = defaultOutputs
+	}
+	var names []string
+	for _, output := range outputs {
+		outputType := strings.ToLower(output.Type)
+		if !contains(emailOutputTypes, outputType) {
+			continue
+		}
+		if len(output.Name) == 0 {
+			output.Name = outputType
+		}
+		names = append(names, output.Name)
+	}
+	return names
+}
+
+func newTransports(d *Dispatch, target DispatchTarget) ([]Transport, error) {
+	outputs := target.Outputs
+	if len(outputs) == 0 {
+		outputs = defaultOutputs
+	}
+
+	var transports []Transport
+	names := map[string]bool{}
+	for _, output := range outputs {
+		output.Type = strings.ToLower(output.Type)
+		if len(output.Name) == 0 {
+			output.Name = output.Type
+		}
+		if names[output.Name] {
+			return nil, fmt.Errorf("output '%s' is defined more than once", output.Name)
+		}
+		names[output.Name] = true
+
+		factory, found := transportTypes[output.Type]
+		if !found {
+			return nil, fmt.Errorf("output '%s' has unknown type '%s'", output.Name, output.Type)
+		}
+		transport, err := factory(d, target, output)
+		if err != nil {
+			return nil, fmt.Errorf("output '%s': %v", output.Name, err)
+		}
+		transports = append(transports, transport)
+	}
+	return transports, nil
+}
+
+// DeliveryResult records the outcome of sending a message to one output
+type DeliveryResult struct {
+	Output string
+	Err    error
+}
+
+// HTTPError is returned when a web service responds with an error status
+type HTTPError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("server responded %d %s", e.StatusCode, e.Body)
+}
+
+// doJSON sends the payload as JSON and decodes a JSON response into result
+// when it is not nil
+func doJSON(ctx context.Context, client *http.Client, method, url string,
+	headers map[string]string, payload interface{}, result interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return newHTTPError(resp)
+	}
+	if result != nil {
+		return json.NewDecoder(resp.Body).Decode(result)
+	}
+	return nil
+}
+
+func newHTTPError(resp *http.Response) error {
+	// only keep the start of the body, some services return whole pages
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	return &HTTPError{resp.StatusCode, strings.TrimSpace(string(data))}
+}
+
+// checkURL makes sure a web service answers, any response status will do
+func checkURL(ctx context.Context, client *http.Client, url string) error {
+	req, err := http.NewRequestWithContext(ctx, "HEAD", url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
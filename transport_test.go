@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testTransport struct {
+	sync.Mutex
+	name     string
+	err      error
+	messages []Message
+}
+
+func (t *testTransport) Name() string { return t.name }
+
+func (t *testTransport) Send(ctx context.Context, message Message) error {
+	t.Lock()
+	defer t.Unlock()
+	t.messages = append(t.messages, message)
+	return t.err
+}
+
+func (t *testTransport) Check(ctx context.Context) error { return t.err }
+
+func TestNewTransports(t *testing.T) {
+	d := NewDispatch(t.TempDir(), SMTPSettings{})
+
+	transports, err := newTransports(d, DispatchTarget{To: []string{"admin@my-site.com"}})
+	assert.NoError(t, err)
+	assert.Len(t, transports, 1)
+	assert.Equal(t, "smtp", transports[0].Name())
+
+	_, err = newTransports(d, DispatchTarget{})
+	assert.Error(t, err)
+
+	_, err = newTransports(d, DispatchTarget{Outputs: []OutputConfig{{Type: "pigeon"}}})
+	assert.Error(t, err)
+
+	_, err = newTransports(d, DispatchTarget{To: []string{"admin@my-site.com"},
+		Outputs: []OutputConfig{{Type: "smtp"}, {Type: "smtp"}}})
+	assert.Error(t, err)
+}
+
+func TestSendTargetFanOut(t *testing.T) {
+	d := NewDispatch(t.TempDir(), SMTPSettings{})
+	ok := &testTransport{name: "ok"}
+	broken := &testTransport{name: "broken", err: errors.New("down")}
+	target := DispatchTarget{Name: "example", transports: []Transport{ok, broken}}
+
+	_, err := d.SendTarget(target, DispatchRequest{"message": "hello"})
+	assert.NoError(t, err)
+	assert.Len(t, ok.messages, 1)
+	assert.Len(t, broken.messages, 1)
+	assert.Equal(t, "hello", ok.messages[0].Fields["message"])
+
+	target.transports = []Transport{broken}
+	_, err = d.SendTarget(target, DispatchRequest{"message": "hello"})
+	assert.Equal(t, ErrDeliveryFailed, err)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/Masterminds/sprig/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultWebhookTemplate = `{{ toJson .Fields }}`
+
+// WebhookTransport sends messages to an arbitrary web service
+type WebhookTransport struct {
+	name     string
+	settings webhookSettings
+	template *template.Template
+	client   *http.Client
+}
+
+type webhookSettings struct {
+	URL             string            `yaml:"url"`
+	Method          string            `yaml:"method"`
+	Template        string            `yaml:"template"`
+	ContentType     string            `yaml:"content-type"`
+	Headers         map[string]string `yaml:"headers"`
+	Secret          string            `yaml:"secret"`
+	SignatureHeader string            `yaml:"signature-header"`
+	Timeout         time.Duration     `yaml:"timeout"`
+	Retries         *int              `yaml:"retries"`
+	RetryDelay      time.Duration     `yaml:"retry-delay"`
+}
+
+// webhookData is what the body template is rendered with
+type webhookData struct {
+	Subject string
+	From    string
+	To      []string
+	Text    string
+	HTML    string
+	Fields  map[string]string
+}
+
+func newWebhookTransport(d *Dispatch, target DispatchTarget, config OutputConfig) (Transport, error) {
+	t := &WebhookTransport{name: config.Name}
+	s := &t.settings
+	if err := config.decode(s); err != nil {
+		return nil, err
+	}
+	if err := resolveSecrets(&s.Secret); err != nil {
+		return nil, err
+	}
+	for key, value := range s.Headers {
+		if err := resolveSecrets(&value); err != nil {
+			return nil, fmt.Errorf("header %s: %v", key, err)
+		}
+		s.Headers[key] = value
+	}
+	if len(s.URL) == 0 {
+		return nil, errors.New("a url is required")
+	}
+	if len(s.Method) == 0 {
+		s.Method = "POST"
+	}
+	s.Method = strings.ToUpper(s.Method)
+	if len(s.Template) == 0 {
+		s.Template = defaultWebhookTemplate
+	}
+	if len(s.ContentType) == 0 {
+		s.ContentType = "application/json"
+	}
+	if len(s.SignatureHeader) == 0 {
+		s.SignatureHeader = "X-Dispatch-Signature"
+	}
+	if s.Timeout == 0 {
+		s.Timeout = 10 * time.Second
+	}
+	if s.Retries == nil {
+		retries := 3
+		s.Retries = &retries
+	}
+	if s.RetryDelay == 0 {
+		s.RetryDelay = time.Second
+	}
+
+	var err error
+	t.template, err = template.New(config.Name).Funcs(sprig.TxtFuncMap()).Parse(s.Template)
+	if err != nil {
+		return nil, err
+	}
+	t.client = &http.Client{Timeout: s.Timeout}
+	return t, nil
+}
+
+// Name returns the output name
+func (t *WebhookTransport) Name() string {
+	return t.name
+}
+
+// Send renders the body and sends it, retrying on server errors
+func (t *WebhookTransport) Send(ctx context.Context, message Message) error {
+	var body bytes.Buffer
+	err := t.template.Execute(&body, webhookData{
+		Subject: message.Subject,
+		From:    message.FromAddress,
+		To:      message.ToAddressList,
+		Text:    message.TextMessage,
+		HTML:    message.HTMLMessage,
+		Fields:  message.Fields,
+	})
+	if err != nil {
+		return err
+	}
+
+	delay := t.settings.RetryDelay
+	for attempt := 0; ; attempt++ {
+		err = t.send(ctx, body.Bytes())
+		if err == nil || !isRetryable(err) || attempt >= *t.settings.Retries {
+			return err
+		}
+		log.Debugf("webhook %s: %v, retrying in %s", t.name, err, delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		delay *= 2
+	}
+}
+
+func (t *WebhookTransport) send(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, t.settings.Method, t.settings.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", t.settings.ContentType)
+	for key, value := range t.settings.Headers {
+		req.Header.Set(key, value)
+	}
+	if len(t.settings.Secret) > 0 {
+		req.Header.Set(t.settings.SignatureHeader, signBody(t.settings.Secret, body))
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return newHTTPError(resp)
+	}
+	return nil
+}
+
+// Check makes sure the web service can be reached, without sending a message
+func (t *WebhookTransport) Check(ctx context.Context) error {
+	return checkURL(ctx, t.client, t.settings.URL)
+}
+
+// signBody returns the hex encoded HMAC-SHA256 of the body
+func signBody(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// isRetryable returns true for connection errors and server errors
+func isRetryable(err error) bool {
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.StatusCode >= 500
+	}
+	return !errors.Is(err, context.Canceled)
+}
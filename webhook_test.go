@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhookTransport(t *testing.T) {
+	attempts := 0
+	var body []byte
+	var headers http.Header
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(503)
+			return
+		}
+		body, _ = ioutil.ReadAll(r.Body)
+		headers = r.Header
+	}))
+	defer stub.Close()
+
+	transport, err := newWebhookTransport(nil, DispatchTarget{}, OutputConfig{Name: "crm", Type: "webhook",
+		Options: map[string]interface{}{
+			"url":         stub.URL,
+			"secret":      "secret",
+			"headers":     map[string]interface{}{"X-Site": "my-site"},
+			"retry-delay": "1ms",
+		}})
+	assert.NoError(t, err)
+
+	err = transport.Send(context.Background(), Message{Fields: map[string]string{"name": "anon"}})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, attempts)
+	assert.Equal(t, `{"name":"anon"}`, string(body))
+	assert.Equal(t, "my-site", headers.Get("X-Site"))
+	assert.Equal(t, signBody("secret", body), headers.Get("X-Dispatch-Signature"))
+}
+
+func TestWebhookTransportNoRetry(t *testing.T) {
+	attempts := 0
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(400)
+	}))
+	defer stub.Close()
+
+	transport, err := newWebhookTransport(nil, DispatchTarget{}, OutputConfig{Name: "crm", Type: "webhook",
+		Options: map[string]interface{}{
+			"url":      stub.URL,
+			"template": `{"who": {{ .Fields.name | quote }}}`,
+		}})
+	assert.NoError(t, err)
+
+	err = transport.Send(context.Background(), Message{Fields: map[string]string{"name": "anon"}})
+	assert.Error(t, err)
+	assert.Equal(t, 1, attempts)
+}
+
+func TestSignBody(t *testing.T) {
+	assert.Equal(t, "sha256=f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8",
+		signBody("key", []byte("The quick brown fox jumps over the lazy dog")))
+}